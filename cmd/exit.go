@@ -0,0 +1,54 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+)
+
+// Exit codes of rabbitio, any other error exits with 1
+const (
+	exitConnection      = 2
+	exitQueueMissing    = 3
+	exitQueueEmpty      = 4
+	exitPublish         = 5
+	exitExchangeMissing = 6
+	exitVerify          = 7
+	exitTopology        = 8
+)
+
+// exitCode returns the exit code for the error returned by a command
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, rmq.ErrQueueMissing):
+		return exitQueueMissing
+	case errors.Is(err, rmq.ErrQueueEmpty):
+		return exitQueueEmpty
+	case errors.Is(err, rmq.ErrExchangeMissing):
+		return exitExchangeMissing
+	case errors.Is(err, rmq.ErrTopologyMismatch):
+		return exitTopology
+	case errors.Is(err, rmq.ErrPublish):
+		return exitPublish
+	case errors.Is(err, rmq.ErrConnection):
+		return exitConnection
+	case errors.Is(err, file.ErrVerify):
+		return exitVerify
+	}
+	return 1
+}
@@ -0,0 +1,51 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"publish failure", fmt.Errorf("%w: 2 messages were not restored", rmq.ErrPublish), exitPublish},
+		{"wrapped publish failure", fmt.Errorf("worker 2: %w", fmt.Errorf("%w: 2 messages were not restored", rmq.ErrPublish)), exitPublish},
+		{"topology mismatch", fmt.Errorf("%w: Exchange Declare: Exception (406) Reason: \"PRECONDITION_FAILED\"", rmq.ErrTopologyMismatch), exitTopology},
+		{"interrupted while reconnecting", fmt.Errorf("consumption stopped after 3 messages: %w", fmt.Errorf("%w: stopped while reconnecting", rmq.ErrConnection)), exitConnection},
+		{"interrupted with held messages", errors.New("consumption stopped after 3 messages, as 3 held messages take up the prefetch"), 1},
+		{"queue missing", fmt.Errorf("%w: Queue Declare: Exception (404) Reason: \"NOT_FOUND\"", rmq.ErrQueueMissing), exitQueueMissing},
+		{"queue empty", fmt.Errorf("%w: no messages in RabbitMQ Queue: queue", rmq.ErrQueueEmpty), exitQueueEmpty},
+		{"exchange missing", fmt.Errorf("%w: Exchange Declare: Exception (404) Reason: \"NOT_FOUND\"", rmq.ErrExchangeMissing), exitExchangeMissing},
+		{"connection", fmt.Errorf("%w: failed to connect to Rabbit: dial tcp: connection refused", rmq.ErrConnection), exitConnection},
+		{"verify", fmt.Errorf("%w: 1 of 3 tarballs failed", file.ErrVerify), exitVerify},
+		{"generic", errors.New("--max-queue-depth needs a --depth-queue"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, exitCode(tt.err))
+		})
+	}
+}
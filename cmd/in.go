@@ -16,7 +16,9 @@ package cmd
 
 import (
 	"errors"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/meltwater/rabbitio/file"
 	"github.com/meltwater/rabbitio/rmq"
@@ -24,40 +26,140 @@ import (
 )
 
 var (
-	fileInput string
+	fileInputs    []string
+	recursive     bool
+	rate          float64
+	burst         int
+	pauseBlocked  bool
+	depthQueue    string
+	maxQueueDepth int
+	timing        string
+	speed         float64
+	maxGap        time.Duration
+	workers       int
+	connections   bool
+	preserveOrder bool
+	identities    []string
+	keepUserID    bool
 )
 
 // inCmd represents the in command
 var inCmd = &cobra.Command{
 	Use:   "in",
 	Short: "Publishes documents from tarballs into RabbitMQ exchange",
-	Long:  `Specify a directory or file and tarballs will be published.`,
+	Long: `Specify directories, files or glob patterns with -f and tarballs will
+	be published in natural order, use -f - to read a stream of tarballs from
+	stdin.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		if fileInput == "" {
+		if len(fileInputs) == 0 {
 			return errors.New("please specify a tarball or directory with tarballs using the -f flag")
 		}
 		channel := make(chan rmq.Message, prefetch)
 
-		override := rmq.Override{RoutingKey: routingKey}
-		path, err := file.NewInput(fileInput)
+		override := rmq.Override{RoutingKey: routingKey, KeepUserID: keepUserID}
+		f, err := parseFilter()
 		if err != nil {
 			return err
 		}
+		topology, err := parseTopology()
+		if err != nil {
+			return err
+		}
+		var replay *rmq.Replay
+		if timing != "" {
+			if replay, err = rmq.NewReplay(timing, speed, maxGap); err != nil {
+				return err
+			}
+		}
+		path, err := file.NewInputs(fileInputs, recursive)
+		if err != nil {
+			return err
+		}
+		path.Filter = f
+		if path.Identities, err = file.ParseIdentities(identities); err != nil {
+			return err
+		}
+		if err := path.CheckIdentities(); err != nil {
+			return err
+		}
+		path.Workers = workers
 
 		var wg sync.WaitGroup
 		path.Wg = &wg
-		rabbit := rmq.NewPublisher(uri, exchange, queue, tag, prefetch)
+		rabbit, err := rmq.NewPublishers(uri, exchange, queue, tag, prefetch, workers, connections, topology)
+		if err != nil {
+			return err
+		}
 		rabbit.Wg = &wg
+		rabbit.Backoff.Attempts = reconnectAttempts
+		rabbit.PreserveOrder = preserveOrder
 		defer rabbit.Close()
+		rabbit.Throttle = rmq.Throttle{
+			Rate:         rate,
+			Burst:        burst,
+			PauseBlocked: pauseBlocked,
+			Queue:        depthQueue,
+			MaxDepth:     maxQueueDepth,
+		}
+		if maxQueueDepth > 0 {
+			if depthQueue == "" {
+				return errors.New("--max-queue-depth needs a --depth-queue")
+			}
+			depth, err := rabbit.QueueDepth(depthQueue)
+			if err != nil {
+				return err
+			}
+			log.Printf("Throttling on queue %s with %d messages, up to %d", depthQueue, depth, maxQueueDepth)
+		}
 
-		go rabbit.Publish(channel, override)
+		start := time.Now()
+		published := make(chan error, 1)
+		go func() {
+			published <- rabbit.Publish(channel, override)
+		}()
 
-		return path.Send(channel)
+		// with a timing the messages are paced by when they were captured
+		sent := channel
+		if replay != nil {
+			sent = make(chan rmq.Message, prefetch)
+			go replay.Pace(sent, channel)
+		}
+		if err := path.Send(sent); err != nil {
+			return err
+		}
+		err = <-published
+		elapsed := time.Since(start)
+
+		failures := rabbit.Failures()
+		confirmed := rabbit.Confirmed()
+		log.Printf("Restored %d messages confirmed by RabbitMQ in %s, %.0f messages/s, %d failed",
+			confirmed, elapsed.Round(time.Millisecond), float64(confirmed)/elapsed.Seconds(), len(failures))
+		for _, f := range failures {
+			log.Printf("Failed: %s in %s: %s", f.Message.Entry, f.Message.Tarball, f.Reason)
+		}
+		return err
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(inCmd)
-	inCmd.Flags().StringVarP(&fileInput, "file", "f", "", "File is specified as either file or directory to restore into RabbitMQ")
+	inCmd.Flags().StringArrayVarP(&fileInputs, "file", "f", nil, "File, directory or glob pattern like 'backups/**/*.tgz' to restore into RabbitMQ, or - for stdin, repeat for more")
+	inCmd.Flags().StringArrayVar(&identities, "identity", nil, "age identity file to decrypt encrypted tarballs with, repeat for more")
+	inCmd.Flags().BoolVar(&recursive, "recursive", false, "Read the tarballs in subdirectories of directories")
+	inCmd.Flags().IntVar(&workers, "workers", 1, "Publish over this number of channels, and decompress as many tarballs ahead")
+	inCmd.Flags().BoolVar(&connections, "worker-connections", false, "Open a connection for every worker instead of a channel each on one connection")
+	inCmd.Flags().BoolVar(&keepUserID, "keep-user-id", false, "Restore the user_id property, RabbitMQ only accepts it when publishing as the same user")
+	inCmd.Flags().BoolVar(&preserveOrder, "preserve-order", false, "Publish the messages with the same routing key in order on the same worker")
+	inCmd.Flags().Float64Var(&rate, "rate", 0, "Publish at most this number of messages per second, 0 is unlimited")
+	inCmd.Flags().IntVar(&burst, "burst", 0, "Messages published at once without waiting for --rate, 0 is a tenth of the rate")
+	inCmd.Flags().BoolVar(&pauseBlocked, "pause-blocked", false, "Pause publishing while RabbitMQ blocks the connection")
+	inCmd.Flags().StringVar(&depthQueue, "depth-queue", "", "Queue to watch the depth of with --max-queue-depth")
+	inCmd.Flags().IntVar(&maxQueueDepth, "max-queue-depth", 0, "Pause publishing while the --depth-queue has more messages")
+	inCmd.Flags().StringVar(&timing, "timing", "", "Replay the messages spaced like when captured, by when they were consumed or their timestamp property: consumed or timestamp")
+	inCmd.Flags().Float64Var(&speed, "speed", 1, "Speed up replaying with --timing, e.g. 10 for ten times faster")
+	inCmd.Flags().DurationVar(&maxGap, "max-gap", 0, "Longest wait between two messages with --timing, e.g. 1m")
+	inCmd.Flags().StringVar(&declareFrom, "declare-from", "", "Declare the exchange and queue recorded in the manifest of this backup directory when missing, only backups taken with out --declare record them")
+	topologyFlags(inCmd.Flags())
+	inCmd.Flags().StringVar(&filterExpression, "filter", "", "Only publish messages matching the filter expression, e.g. 'headers.retries >= 3'")
 }
@@ -0,0 +1,292 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectJSON     bool
+	inspectBody     bool
+	inspectPretty   bool
+	inspectEntry    []string
+	inspectManifest bool
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Lists and prints the messages in tarballs without connecting to RabbitMQ",
+	Long: `Specify a directory or file and the messages in the tarballs are listed
+	with their entry name, size, routing key and headers. Use --body to print
+	the bodies of the messages, selected with --entry or --filter, and --json
+	for JSON lines. Use --manifest to list the tarballs of a backup directory
+	with the source, recipients and redactions of the run that wrote them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if len(fileInputs) == 0 {
+			return errors.New("please specify a tarball or directory with tarballs using the -f flag")
+		}
+		if inspectManifest {
+			for _, dir := range fileInputs {
+				m, err := file.ReadManifest(dir)
+				if err != nil {
+					return err
+				}
+				if err := printManifest(os.Stdout, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		f, err := parseFilter()
+		if err != nil {
+			return err
+		}
+		path, err := file.NewInputs(fileInputs, recursive)
+		if err != nil {
+			return err
+		}
+		path.Filter = f
+		if path.Identities, err = file.ParseIdentities(identities); err != nil {
+			return err
+		}
+		if err := path.CheckIdentities(); err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		path.Wg = &wg
+		channel := make(chan rmq.Message, prefetch)
+
+		entries := make(map[string]bool)
+		for _, e := range inspectEntry {
+			entries[e] = true
+		}
+
+		var p printer
+		switch {
+		case inspectJSON:
+			p = &jsonPrinter{w: os.Stdout, body: inspectBody, pretty: inspectPretty}
+		case inspectBody:
+			p = &bodyPrinter{w: os.Stdout, pretty: inspectPretty}
+		default:
+			p = newTablePrinter(os.Stdout)
+		}
+
+		printed := make(chan error, 1)
+		go func() {
+			var err error
+			for m := range channel {
+				if err == nil && (len(entries) == 0 || entries[m.Entry]) {
+					err = p.print(&m)
+				}
+				wg.Done()
+			}
+			if err == nil {
+				err = p.flush()
+			}
+			printed <- err
+		}()
+
+		if err := path.Send(channel); err != nil {
+			return err
+		}
+		return <-printed
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringArrayVarP(&fileInputs, "file", "f", nil, "File, directory or glob pattern to inspect, or - for stdin, repeat for more")
+	inspectCmd.Flags().StringArrayVar(&identities, "identity", nil, "age identity file to decrypt encrypted tarballs with, repeat for more")
+	inspectCmd.Flags().BoolVar(&recursive, "recursive", false, "Read the tarballs in subdirectories of directories")
+	inspectCmd.Flags().BoolVar(&inspectJSON, "json", false, "Print the messages as JSON lines")
+	inspectCmd.Flags().BoolVar(&inspectBody, "body", false, "Print the message bodies")
+	inspectCmd.Flags().BoolVar(&inspectPretty, "pretty", false, "Pretty print JSON bodies and output")
+	inspectCmd.Flags().StringSliceVar(&inspectEntry, "entry", nil, "Only print the messages with these entry names")
+	inspectCmd.Flags().StringVar(&filterExpression, "filter", "", "Only print messages matching the filter expression")
+	inspectCmd.Flags().BoolVar(&inspectManifest, "manifest", false, "Print the tarballs listed in the manifest of the directories with the runs that wrote them")
+}
+
+// printManifest lists the tarballs of a manifest with the source, recipients
+// and redactions recorded by the run that wrote each of them
+func printManifest(w io.Writer, m *file.Manifest) error {
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "TARBALL\tMESSAGES\tRUN\tQUEUE\tEXCHANGE\tENCRYPTED TO\tREDACTIONS")
+	for _, f := range m.Files {
+		queue, exchange, recipients, redactions := "-", "-", "-", "-"
+		if r := m.Run(f.Run); r != nil {
+			queue, exchange = r.Queue, r.Exchange
+			if len(r.Recipients) > 0 {
+				recipients = strings.Join(r.Recipients, ",")
+			}
+			if len(r.Redactions) > 0 {
+				redactions = strings.Join(r.Redactions, "; ")
+				if r.RedactionKey != "" {
+					redactions += fmt.Sprintf(" (key %s)", r.RedactionKey)
+				}
+			}
+		}
+		if _, err := fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", f.Name, f.Messages, f.Run, queue, exchange, recipients, redactions); err != nil {
+			return err
+		}
+	}
+	return t.Flush()
+}
+
+// printer prints the inspected messages
+type printer interface {
+	print(m *rmq.Message) error
+	flush() error
+}
+
+// tablePrinter lists the messages in aligned columns
+type tablePrinter struct {
+	w *tabwriter.Writer
+}
+
+func newTablePrinter(w io.Writer) *tablePrinter {
+	t := &tablePrinter{w: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+	fmt.Fprintln(t.w, "TARBALL\tENTRY\tSIZE\tROUTING KEY\tHEADERS")
+	return t
+}
+
+func (t *tablePrinter) print(m *rmq.Message) error {
+	headers := ""
+	if len(m.Headers) > 0 {
+		b, err := json.Marshal(m.Headers)
+		if err != nil {
+			headers = fmt.Sprint(m.Headers)
+		} else {
+			headers = string(b)
+		}
+	}
+	_, err := fmt.Fprintf(t.w, "%s\t%s\t%d\t%s\t%s\n", filepath.Base(m.Tarball), m.Entry, len(m.Body), m.RoutingKey, headers)
+	return err
+}
+
+func (t *tablePrinter) flush() error {
+	return t.w.Flush()
+}
+
+// bodyPrinter prints the message bodies after a line naming the entry
+type bodyPrinter struct {
+	w      io.Writer
+	pretty bool
+}
+
+func (b *bodyPrinter) print(m *rmq.Message) error {
+	if _, err := fmt.Fprintf(b.w, "==> %s:%s <==\n", m.Tarball, m.Entry); err != nil {
+		return err
+	}
+	_, err := b.w.Write(append(prettyBody(m.Body, b.pretty), '\n'))
+	return err
+}
+
+func (b *bodyPrinter) flush() error {
+	return nil
+}
+
+// jsonPrinter prints a JSON object for every message
+type jsonPrinter struct {
+	w            io.Writer
+	body, pretty bool
+}
+
+// inspected is the JSON output of a message
+type inspected struct {
+	Tarball    string            `json:"tarball"`
+	Entry      string            `json:"entry"`
+	Size       int               `json:"size"`
+	RoutingKey string            `json:"routing_key"`
+	Headers    interface{}       `json:"headers,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Redacted   []string          `json:"redacted,omitempty"`
+	Body       interface{}       `json:"body,omitempty"`
+	BodyBase64 []byte            `json:"body_base64,omitempty"`
+}
+
+func (j *jsonPrinter) print(m *rmq.Message) error {
+	i := inspected{
+		Tarball:    m.Tarball,
+		Entry:      m.Entry,
+		Size:       len(m.Body),
+		RoutingKey: m.RoutingKey,
+		Properties: m.Properties.Map(),
+		Redacted:   m.Redacted,
+	}
+	if len(m.Headers) > 0 {
+		i.Headers = m.Headers
+		if _, err := json.Marshal(m.Headers); err != nil {
+			i.Headers = fmt.Sprint(m.Headers)
+		}
+	}
+	if j.body {
+		switch {
+		case j.pretty && json.Valid(m.Body):
+			i.Body = json.RawMessage(m.Body)
+		case utf8.Valid(m.Body):
+			i.Body = string(m.Body)
+		default:
+			i.BodyBase64 = m.Body
+		}
+	}
+
+	var b []byte
+	var err error
+	if j.pretty {
+		b, err = json.MarshalIndent(i, "", "  ")
+	} else {
+		b, err = json.Marshal(i)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+func (j *jsonPrinter) flush() error {
+	return nil
+}
+
+// prettyBody indents JSON bodies when pretty printing
+func prettyBody(body []byte, pretty bool) []byte {
+	if !pretty || !json.Valid(body) {
+		return body
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		return body
+	}
+	return buf.Bytes()
+}
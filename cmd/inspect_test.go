@@ -0,0 +1,122 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden compares the output with testdata/name, or writes it with -update
+func golden(t *testing.T, name string, output []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		require.NoError(t, os.WriteFile(path, output, 0644))
+	}
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(output))
+}
+
+// inspectMessages are a redacted message with typed headers and properties,
+// and a message from a tarball written before properties were stored
+func inspectMessages() []rmq.Message {
+	sent := time.Date(2018, 4, 11, 14, 26, 29, 0, time.UTC)
+	return []rmq.Message{
+		{
+			Tarball:    "backups/1_messages_2.tgz",
+			Entry:      "1.rio",
+			RoutingKey: "orders.created",
+			Headers: amqp.Table{
+				"count":   int32(3),
+				"ratio":   float32(0.5),
+				"sent":    sent,
+				"tags":    []interface{}{"eu", int64(1)},
+				"x-user":  "hmac-sha256:5d41402abc4b2a76",
+				"retried": true,
+			},
+			Properties: rmq.Properties{
+				ContentType:  "application/json",
+				DeliveryMode: amqp.Persistent,
+				MessageID:    "order-1",
+				Timestamp:    sent,
+			},
+			Redacted: []string{"hash header x-user-*", "mask json $.customer.email"},
+			Body:     []byte(`{"customer":{"email":"***"},"id":1}`),
+		},
+		{
+			Tarball:    "backups/1_messages_2.tgz",
+			Entry:      "2.rio",
+			RoutingKey: "orders.legacy",
+			Body:       []byte{0xff, 0xfe, 0x00},
+		},
+	}
+}
+
+func TestInspectPrinters(t *testing.T) {
+	tests := []struct {
+		name    string
+		printer func(w *bytes.Buffer) printer
+	}{
+		{"inspect_table.golden", func(w *bytes.Buffer) printer { return newTablePrinter(w) }},
+		{"inspect_body.golden", func(w *bytes.Buffer) printer { return &bodyPrinter{w: w, pretty: true} }},
+		{"inspect_json.golden", func(w *bytes.Buffer) printer { return &jsonPrinter{w: w, body: true} }},
+		{"inspect_json_pretty.golden", func(w *bytes.Buffer) printer { return &jsonPrinter{w: w, body: true, pretty: true} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			p := tt.printer(&w)
+			for _, m := range inspectMessages() {
+				require.NoError(t, p.print(&m))
+			}
+			require.NoError(t, p.flush())
+
+			golden(t, tt.name, w.Bytes())
+		})
+	}
+}
+
+func TestPrintManifest(t *testing.T) {
+	m := &file.Manifest{
+		Runs: []file.ManifestRun{
+			{ID: "20180315T154000Z", Queue: "orders", Exchange: "shop", Recipients: []string{"age1first", "age1second"}},
+			{ID: "20180316T091500Z", Queue: "users", Exchange: "shop", Redactions: []string{"drop header token", "hash header x-user-*"}, RedactionKey: "9f9f5111f7b27a78"},
+		},
+		Files: []file.ManifestFile{
+			{Name: "20180315T154000Z_1_messages_100.tgz.age", Run: "20180315T154000Z", Messages: 100},
+			{Name: "20180316T091500Z_1_messages_7.tgz", Run: "20180316T091500Z", Messages: 7},
+			{Name: "unknown_1_messages_1.tgz", Run: "unknown", Messages: 1},
+		},
+	}
+	var w bytes.Buffer
+
+	require.NoError(t, printManifest(&w, m))
+
+	golden(t, "inspect_manifest.golden", w.Bytes())
+}
@@ -0,0 +1,244 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/cobra"
+)
+
+var (
+	targetURI, targetExchange, targetRoutingKey string
+	auditDirectory                              string
+)
+
+// moveCmd represents the move command
+var moveCmd = &cobra.Command{
+	Use:   "move",
+	Short: "Moves messages from a RabbitMQ queue to an exchange without touching disk",
+	Long: `Consumes messages from the queue and publishes them to the target exchange,
+	on the same or another RabbitMQ given by --target-uri. Every message is
+	acked on the queue once the target has confirmed it, messages that fail to
+	publish are left in the queue. Use --audit-directory to also store a copy
+	of the moved messages in tarballs.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if targetURI == "" {
+			targetURI = uri
+		}
+		if targetExchange == "" {
+			targetExchange = exchange
+		}
+
+		f, err := parseFilter()
+		if err != nil {
+			return err
+		}
+		var audit *file.Path
+		if auditDirectory != "" {
+			c, err := file.ParseCompression(compression)
+			if err != nil {
+				return err
+			}
+			recipients, err := file.ParseRecipients(encryptTo)
+			if err != nil {
+				return err
+			}
+			if audit, err = file.NewOutput(auditDirectory, batchSize); err != nil {
+				return err
+			}
+			audit.AckEach = true
+			audit.Manifest = newManifest()
+			audit.Compression = c
+			audit.Recipients = recipients
+		}
+
+		var wg sync.WaitGroup
+		target, err := rmq.NewPublisher(targetURI, targetExchange, "", tag, prefetch, nil)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		target.Wg = &wg
+		target.Backoff.Attempts = reconnectAttempts
+
+		// the messages not matching the filter are held unacked, up to
+		// --prefetch of them on top of the messages in flight
+		var held int
+		if f != nil {
+			held = prefetch
+		}
+		// with an audit copy the messages are only acked once their batch is written
+		sourcePrefetch := prefetch + held
+		if audit != nil {
+			if sourcePrefetch, err = consumerPrefetch(1, held); err != nil {
+				return err
+			}
+		}
+		source, err := rmq.NewConsumer(uri, exchange, queue, routingKey, tag, sourcePrefetch, nil)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		source.Backoff.Attempts = reconnectAttempts
+
+		// messages are acked on the source when confirmed by the target, and
+		// written to the audit tarballs when auditing
+		acks := make(chan rmq.Verify)
+		target.Acks = acks
+		verify := acks
+		var audited chan rmq.Message
+		var auditErr chan error
+		if audit != nil {
+			audited = make(chan rmq.Message, prefetch)
+			auditVerify := make(chan rmq.Verify)
+			auditErr = make(chan error, 1)
+			go func() {
+				err := audit.Receive(audited, auditVerify)
+				if err != nil {
+					// the messages moved without a copy are not acked
+					source.Stop()
+					for range audited {
+					}
+				}
+				auditErr <- err
+			}()
+			verify = make(chan rmq.Verify)
+			go joinAcks(verify, acks, auditVerify)
+		}
+
+		options := rmq.ConsumeOptions{
+			UntilEmpty:  untilEmpty,
+			IdleTimeout: idleTimeout,
+			MaxMessages: maxMessages,
+			MaxHeld:     held,
+		}
+		consumed := make(chan rmq.Message, prefetch)
+		consumeErr := make(chan error, 1)
+		go func() {
+			consumeErr <- source.Consume(consumed, verify, options)
+		}()
+
+		publishing := make(chan rmq.Message, prefetch)
+		published := make(chan error, 1)
+		go func() {
+			published <- target.Publish(publishing, rmq.Override{RoutingKey: targetRoutingKey, KeepUserID: keepUserID})
+		}()
+
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			fmt.Fprintln(os.Stderr, " Interruption, finishing the messages in flight..")
+			source.Stop()
+		}()
+
+		var skipped int
+		for m := range consumed {
+			// messages not matching the filter are requeued when the channel closes
+			if !f.Match(&m) {
+				source.Hold(m)
+				skipped++
+				continue
+			}
+			wg.Add(1)
+			if audited != nil {
+				audited <- m
+			}
+			publishing <- m
+		}
+		if audited != nil {
+			close(audited)
+		}
+		wg.Wait()
+		close(publishing)
+		err = <-published
+		close(acks)
+
+		failures := target.Failures()
+		log.Printf("Moved %d messages confirmed by the target, %d failed", target.Confirmed(), len(failures))
+		for _, f := range failures {
+			log.Printf("Failed: message with routing key %q left in the queue: %s", f.Message.RoutingKey, f.Reason)
+		}
+		if skipped > 0 {
+			log.Printf("Left %d messages not matching the filter in the queue", skipped)
+		}
+
+		if auditErr != nil {
+			if aerr := <-auditErr; aerr != nil {
+				return aerr
+			}
+		}
+		if cerr := <-consumeErr; cerr != nil {
+			return cerr
+		}
+		return err
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(moveCmd)
+
+	moveCmd.Flags().StringVar(&targetURI, "target-uri", "", "AMQP URI of the RabbitMQ to move the messages to, defaults to --uri")
+	moveCmd.Flags().StringVar(&targetExchange, "target-exchange", "", "Exchange to move the messages to, defaults to --exchange")
+	moveCmd.Flags().StringVar(&targetRoutingKey, "target-routingkey", "#", "Routing Key to publish the messages with, the message routing key is kept by default")
+	moveCmd.Flags().BoolVar(&keepUserID, "keep-user-id", false, "Keep the user_id property, RabbitMQ only accepts it when publishing as the same user")
+	moveCmd.Flags().StringVar(&auditDirectory, "audit-directory", "", "Store a copy of the moved messages in tarballs in this directory")
+	moveCmd.Flags().IntVarP(&batchSize, "batch", "b", 1000, "Number of messages stored in each audit tarball")
+	moveCmd.Flags().StringVar(&compression, "compression", file.DefaultCompression.String(), "Compression of the audit tarballs: gzip:1-9, zstd:1-22, lz4 or none")
+	moveCmd.Flags().StringArrayVar(&encryptTo, "encrypt-recipient", nil, "Encrypt the audit tarballs to an age public key, or the keys in a file, repeat for more")
+	moveCmd.Flags().BoolVar(&untilEmpty, "until-empty", false, "Stop when the messages waiting in the queue at start have been moved")
+	moveCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Stop when no messages have been received for the duration, e.g. 10s")
+	moveCmd.Flags().IntVar(&maxMessages, "max-messages", 0, "Stop after moving this number of messages")
+	moveCmd.Flags().StringVar(&filterExpression, "filter", "", "Only move messages matching the filter expression, others are left in the queue")
+}
+
+// joinAcks forwards an ack to out once it has been received from both a and
+// b, out is closed when both are closed
+func joinAcks(out chan<- rmq.Verify, a, b <-chan rmq.Verify) {
+	seen := make(map[rmq.Verify]bool)
+	join := func(v rmq.Verify) {
+		if seen[v] {
+			delete(seen, v)
+			out <- v
+		} else {
+			seen[v] = true
+		}
+	}
+	for a != nil || b != nil {
+		select {
+		case v, ok := <-a:
+			if !ok {
+				a = nil
+				continue
+			}
+			join(v)
+		case v, ok := <-b:
+			if !ok {
+				b = nil
+				continue
+			}
+			join(v)
+		}
+	}
+	close(out)
+}
@@ -0,0 +1,46 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinAcks(t *testing.T) {
+	confirmed := make(chan rmq.Verify, 3)
+	audited := make(chan rmq.Verify, 3)
+	out := make(chan rmq.Verify, 3)
+
+	// the second message is nacked by the target, so it is never confirmed
+	confirmed <- rmq.Verify{Tag: 1, Channel: 1}
+	confirmed <- rmq.Verify{Tag: 3, Channel: 1}
+	close(confirmed)
+	for tag := uint64(1); tag <= 3; tag++ {
+		audited <- rmq.Verify{Tag: tag, Channel: 1}
+	}
+	close(audited)
+
+	joinAcks(out, confirmed, audited)
+
+	var acked []rmq.Verify
+	for v := range out {
+		acked = append(acked, v)
+	}
+	assert.Equal(t, []rmq.Verify{{Tag: 1, Channel: 1}, {Tag: 3, Channel: 1}}, acked,
+		"should leave the nacked message unacked in the source queue")
+}
@@ -16,11 +16,15 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/filter"
 	"github.com/meltwater/rabbitio/rmq"
 	"github.com/spf13/cobra"
 )
@@ -28,6 +32,17 @@ import (
 var (
 	outputDirectory string
 	batchSize       int
+	untilEmpty      bool
+	idleTimeout     time.Duration
+	maxMessages     int
+	rejectedDir     string
+	toStdout        bool
+	compression     string
+	maxBytes        int64
+	maxAge          time.Duration
+	nameTemplate    string
+	overwrite       bool
+	encryptTo       []string
 )
 
 // outCmd represents the out command
@@ -35,35 +50,253 @@ var outCmd = &cobra.Command{
 	Use:   "out",
 	Short: "Consumes data out from RabbitMQ and stores to tarballs",
 	Long: `Select your output directory and batchsize of the tarballs.
-	When there are no more messages in the queue, press CTRL + c, to interrupt
-	the consumption and save the last message buffers.`,
+	Use --until-empty, --idle-timeout or --max-messages to stop when the queue
+	is drained, or press CTRL + c, to interrupt the consumption and save the
+	last message buffers.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		channel := make(chan rmq.Message, prefetch*2)
 		verify := make(chan rmq.Verify)
 
-		rabbit := rmq.NewConsumer(uri, exchange, queue, routingKey, tag, prefetch)
-		path, err := file.NewOutput(outputDirectory, batchSize)
+		f, err := parseFilter()
 		if err != nil {
 			return err
 		}
+		codec, err := file.ParseCompression(compression)
+		if err != nil {
+			return err
+		}
+		names, err := file.NewNamer(nameTemplate, queue)
+		if err != nil {
+			return err
+		}
+		recipients, err := file.ParseRecipients(encryptTo)
+		if err != nil {
+			return err
+		}
+		redactor, err := parseRedactor()
+		if err != nil {
+			return err
+		}
+		topology, err := parseTopology()
+		if err != nil {
+			return err
+		}
+		var path *file.Path
+		if toStdout {
+			path = file.NewStreamOutput(os.Stdout, batchSize)
+		} else if path, err = file.NewOutput(outputDirectory, batchSize); err != nil {
+			return err
+		}
+		if !toStdout {
+			path.Manifest = newManifest()
+			path.Manifest.Topology = topology
+			path.Names = names
+			path.Overwrite = overwrite
+			log.Printf("Naming tarballs %s with run %s", names.Template, names.Run)
+		}
+		path.Compression = codec
+		path.Recipients = recipients
+		path.Redactor = redactor
+		path.MaxBytes = maxBytes
+		path.MaxAge = maxAge
+		var rejectedPath *file.Path
+		if rejectedDir != "" {
+			if f == nil {
+				return fmt.Errorf("--rejected-directory needs a --filter")
+			}
+			rejectedPath, err = file.NewOutput(rejectedDir, batchSize)
+			if err != nil {
+				return err
+			}
+			rejectedPath.Manifest = newManifest()
+			rejectedPath.Names = names
+			rejectedPath.Overwrite = overwrite
+			rejectedPath.Compression = codec
+			rejectedPath.Recipients = recipients
+			rejectedPath.Redactor = redactor
+			rejectedPath.MaxBytes = maxBytes
+			rejectedPath.MaxAge = maxAge
+		}
+		writers := 1
+		if rejectedPath != nil {
+			writers = 2
+		}
+		// without a rejected directory the messages not matching the filter
+		// are held unacked, up to --prefetch of them
+		var held int
+		if f != nil && rejectedPath == nil {
+			held = prefetch
+		}
+		qos, err := consumerPrefetch(writers, held)
+		if err != nil {
+			return err
+		}
+		rabbit, err := rmq.NewConsumer(uri, exchange, queue, routingKey, tag, qos, topology)
+		if err != nil {
+			return err
+		}
+		defer rabbit.Close()
+		rabbit.Backoff.Attempts = reconnectAttempts
+
+		// a failing writer stops the consumption and the split, so the
+		// other writer finishes and the acks are closed
+		done := make(chan struct{})
+		var once sync.Once
+		abort := func() {
+			once.Do(func() { close(done) })
+			rabbit.Stop()
+		}
 
-		go rabbit.Consume(channel, verify)
+		// with a filter the consumed messages are split between the
+		// tarballs, the rejected directory or left unacked to be requeued
+		received, acks := channel, verify
+		var rejectedErr chan error
+		if f != nil {
+			path.AckEach = true
+			channel = make(chan rmq.Message, prefetch*2)
+			verify = make(chan rmq.Verify)
+
+			var rejected chan rmq.Message
+			var rejectedVerify chan rmq.Verify
+			if rejectedPath != nil {
+				rejectedPath.AckEach = true
+				rejected = make(chan rmq.Message, prefetch*2)
+				rejectedVerify = make(chan rmq.Verify)
+				rejectedErr = make(chan error, 1)
+				go func() {
+					err := rejectedPath.Receive(rejected, rejectedVerify)
+					if err != nil {
+						abort()
+					}
+					rejectedErr <- err
+				}()
+			}
+			go split(f, channel, received, rejected, rabbit.Hold, done)
+			go mergeVerify(verify, acks, rejectedVerify)
+		}
+
+		options := rmq.ConsumeOptions{
+			UntilEmpty:  untilEmpty,
+			IdleTimeout: idleTimeout,
+			MaxMessages: maxMessages,
+			MaxHeld:     held,
+		}
+		consumed := make(chan error, 1)
+		go func() {
+			consumed <- rabbit.Consume(channel, verify, options)
+		}()
 
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		go func() {
 			<-c
-			fmt.Println(" Interruption, saving last memory bits..")
-			close(channel)
+			fmt.Fprintln(os.Stderr, " Interruption, saving last memory bits..")
+			rabbit.Stop()
 		}()
 
-		return path.Receive(channel, verify)
+		if err := path.Receive(received, acks); err != nil {
+			abort()
+			return err
+		}
+		if rejectedErr != nil {
+			if err := <-rejectedErr; err != nil {
+				return err
+			}
+		}
+		return <-consumed
 	},
 }
 
+// newManifest records the source of the consumed messages
+func newManifest() *file.Manifest {
+	return &file.Manifest{
+		Version:    version,
+		URI:        rmq.RedactURI(uri),
+		VHost:      rmq.VHost(uri),
+		Exchange:   exchange,
+		Queue:      queue,
+		RoutingKey: routingKey,
+		Started:    time.Now().UTC(),
+	}
+}
+
+// split sends the messages matching the filter to accepted and the others
+// to rejected. Without rejected the others are held unacked, and RabbitMQ
+// requeues them when the channel closes. It stops early once done is closed,
+// as a writer failed and no longer receives
+func split(f *filter.Filter, messages <-chan rmq.Message, accepted, rejected chan<- rmq.Message, hold func(rmq.Message), done <-chan struct{}) {
+	var n int
+loop:
+	for m := range messages {
+		switch {
+		case f.Match(&m):
+			select {
+			case accepted <- m:
+			case <-done:
+				break loop
+			}
+		case rejected != nil:
+			select {
+			case rejected <- m:
+			case <-done:
+				break loop
+			}
+			n++
+		default:
+			hold(m)
+			n++
+		}
+	}
+	close(accepted)
+	if rejected != nil {
+		close(rejected)
+		log.Printf("Rejected %d messages not matching the filter", n)
+	} else if n > 0 {
+		log.Printf("Left %d messages not matching the filter in the queue", n)
+	}
+}
+
+// mergeVerify forwards the acks of both channels to out, closing it when
+// both are closed, a nil channel counts as closed
+func mergeVerify(out chan<- rmq.Verify, a, b <-chan rmq.Verify) {
+	for a != nil || b != nil {
+		select {
+		case v, ok := <-a:
+			if !ok {
+				a = nil
+				continue
+			}
+			out <- v
+		case v, ok := <-b:
+			if !ok {
+				b = nil
+				continue
+			}
+			out <- v
+		}
+	}
+	close(out)
+}
+
 func init() {
 	RootCmd.AddCommand(outCmd)
 
 	outCmd.Flags().StringVarP(&outputDirectory, "directory", "d", ".", "Output directory for files consumed from RabbitMQ")
 	outCmd.Flags().IntVarP(&batchSize, "batch", "b", 1000, "Number of messages stored in each tarball")
+	outCmd.Flags().Int64Var(&maxBytes, "max-bytes", 0, "Rotate tarballs when the message bodies reach this number of bytes")
+	outCmd.Flags().DurationVar(&maxAge, "max-age", 0, "Rotate tarballs when the first message is this old, e.g. 5m")
+	outCmd.Flags().StringVar(&nameTemplate, "name-template", file.DefaultNameTemplate, "Name of the tarballs with {queue}, {time}, {run}, {seq} and {count}, the extension is added")
+	outCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace existing tarballs with the same name instead of adding a number to the name")
+	outCmd.Flags().StringVar(&compression, "compression", file.DefaultCompression.String(), "Compression of the tarballs: gzip:1-9, zstd:1-22, lz4 or none")
+	outCmd.Flags().StringArrayVar(&redactRules, "redact", nil, "Redact the messages with a rule like 'drop header authorization' or 'mask json $.email', repeat for more")
+	outCmd.Flags().StringVar(&redactFile, "redact-file", "", "Redact the messages with the rules in the file, one per line")
+	outCmd.Flags().StringVar(&redactKey, "redact-key", "", "Secret key of at least 16 bytes to hash values with, better set as RABBITIO_REDACT_KEY")
+	outCmd.Flags().StringArrayVar(&encryptTo, "encrypt-recipient", nil, "Encrypt the tarballs to an age public key, or the keys in a file, repeat for more")
+	outCmd.Flags().BoolVar(&toStdout, "stdout", false, "Write one continuous tarball to stdout instead of the directory, flushed every batch")
+	outCmd.Flags().BoolVar(&untilEmpty, "until-empty", false, "Stop when the messages waiting in the queue at start have been consumed")
+	outCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Stop when no messages have been received for the duration, e.g. 10s")
+	outCmd.Flags().IntVar(&maxMessages, "max-messages", 0, "Stop after consuming this number of messages")
+	outCmd.Flags().StringVar(&filterExpression, "filter", "", "Only store messages matching the filter expression, others are left in the queue")
+	outCmd.Flags().StringVar(&rejectedDir, "rejected-directory", "", "Store and ack the messages not matching the filter in this directory")
+	topologyFlags(outCmd.Flags())
 }
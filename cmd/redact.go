@@ -0,0 +1,140 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/cobra"
+)
+
+var (
+	redactDirectory string
+)
+
+// redactCmd represents the redact command
+var redactCmd = &cobra.Command{
+	Use:   "redact",
+	Short: "Rewrites tarballs with the messages redacted, without connecting to RabbitMQ",
+	Long: `Specify tarballs with -f like for in, and the redaction rules with
+	--redact or --redact-file, and the messages are written redacted to new
+	tarballs in the directory given with -d.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if len(fileInputs) == 0 {
+			return errors.New("please specify a tarball or directory with tarballs using the -f flag")
+		}
+		if redactDirectory == "" {
+			return errors.New("please specify the directory for the redacted tarballs using the -d flag")
+		}
+		for _, f := range fileInputs {
+			if filepath.Clean(f) == filepath.Clean(redactDirectory) {
+				return fmt.Errorf("please write the redacted tarballs to another directory than %s", f)
+			}
+		}
+		redactor, err := parseRedactor()
+		if err != nil {
+			return err
+		}
+		if redactor == nil {
+			return errors.New("please specify redaction rules using --redact or --redact-file")
+		}
+		codec, err := file.ParseCompression(compression)
+		if err != nil {
+			return err
+		}
+		names, err := file.NewNamer(nameTemplate, "")
+		if err != nil {
+			return err
+		}
+		recipients, err := file.ParseRecipients(encryptTo)
+		if err != nil {
+			return err
+		}
+
+		path, err := file.NewInputs(fileInputs, recursive)
+		if err != nil {
+			return err
+		}
+		if path.Identities, err = file.ParseIdentities(identities); err != nil {
+			return err
+		}
+		if err := path.CheckIdentities(); err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		path.Wg = &wg
+
+		out, err := file.NewOutput(redactDirectory, batchSize)
+		if err != nil {
+			return err
+		}
+		out.Compression = codec
+		out.Names = names
+		out.Overwrite = overwrite
+		out.Recipients = recipients
+		out.Redactor = redactor
+		out.Manifest = &file.Manifest{Version: version, Started: time.Now().UTC()}
+
+		// the messages are done once handed to the writer, which has no
+		// RabbitMQ to ack them on
+		messages := make(chan rmq.Message, prefetch)
+		redacted := make(chan rmq.Message, prefetch)
+		verify := make(chan rmq.Verify)
+		go func() {
+			for range verify {
+			}
+		}()
+		go func() {
+			for m := range messages {
+				redacted <- m
+				wg.Done()
+			}
+			close(redacted)
+		}()
+		written := make(chan error, 1)
+		go func() {
+			written <- out.Receive(redacted, verify)
+		}()
+
+		if err := path.Send(messages); err != nil {
+			return err
+		}
+		return <-written
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(redactCmd)
+
+	redactCmd.Flags().StringArrayVarP(&fileInputs, "file", "f", nil, "File, directory or glob pattern to redact, or - for stdin, repeat for more")
+	redactCmd.Flags().BoolVar(&recursive, "recursive", false, "Read the tarballs in subdirectories of directories")
+	redactCmd.Flags().StringArrayVar(&identities, "identity", nil, "age identity file to decrypt encrypted tarballs with, repeat for more")
+	redactCmd.Flags().StringVarP(&redactDirectory, "directory", "d", "", "Output directory for the redacted tarballs")
+	redactCmd.Flags().StringArrayVar(&redactRules, "redact", nil, "Redact the messages with a rule like 'drop header authorization' or 'mask json $.email', repeat for more")
+	redactCmd.Flags().StringVar(&redactFile, "redact-file", "", "Redact the messages with the rules in the file, one per line")
+	redactCmd.Flags().StringVar(&redactKey, "redact-key", "", "Secret key of at least 16 bytes to hash values with, better set as RABBITIO_REDACT_KEY")
+	redactCmd.Flags().IntVarP(&batchSize, "batch", "b", 1000, "Number of messages stored in each tarball")
+	redactCmd.Flags().StringVar(&compression, "compression", file.DefaultCompression.String(), "Compression of the tarballs: gzip:1-9, zstd:1-22, lz4 or none")
+	redactCmd.Flags().StringVar(&nameTemplate, "name-template", file.DefaultNameTemplate, "Name of the tarballs with {time}, {run}, {seq} and {count}, the extension is added")
+	redactCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace existing tarballs with the same name instead of adding a number to the name")
+	redactCmd.Flags().StringArrayVar(&encryptTo, "encrypt-recipient", nil, "Encrypt the tarballs to an age public key, or the keys in a file, repeat for more")
+}
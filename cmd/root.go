@@ -15,16 +15,32 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 
+	"github.com/meltwater/rabbitio/config"
+	"github.com/meltwater/rabbitio/filter"
+	"github.com/meltwater/rabbitio/redact"
+	"github.com/meltwater/rabbitio/rmq"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
 	version                               string
 	uri, exchange, queue, tag, routingKey string
-	prefetch                              int
+	prefetch, reconnectAttempts           int
+	filterExpression                      string
+	redactRules                           []string
+	redactFile, redactKey                 string
+	tlsSettings                           rmq.TLS
+	configPath, profile, passwordFile     string
+	// stderr masks the passwords in the error of a command
+	stderr io.Writer = os.Stderr
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -34,15 +50,25 @@ var RootCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := configure(cmd.Root().PersistentFlags()); err != nil {
+			return err
+		}
+		var err error
+		rmq.TLSConfig, err = tlsSettings.Config()
+		return err
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(ver string) {
 	version = ver
+	// errors are printed below with the passwords masked
+	RootCmd.SilenceErrors = true
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(stderr, err)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -52,5 +78,125 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&queue, "queue", "q", "", "Queue to connect to")
 	RootCmd.PersistentFlags().StringVarP(&routingKey, "routingkey", "r", "#", "Routing Key, if specified will override tarball routing key configuration")
 	RootCmd.PersistentFlags().StringVarP(&tag, "tag", "t", "Rabbit IO Connector "+version, "AMQP Client Tag")
-	RootCmd.PersistentFlags().IntVarP(&prefetch, "prefetch", "p", 100, "Prefetch for batches")
+	RootCmd.PersistentFlags().IntVarP(&prefetch, "prefetch", "p", 100, "Unacked messages RabbitMQ delivers at a time, and published messages waiting for a confirm")
+	RootCmd.PersistentFlags().IntVar(&reconnectAttempts, "reconnect-attempts", rmq.DefaultBackoff.Attempts, "Reconnect attempts in a row when the connection to RabbitMQ is lost, 0 disables reconnecting")
+	RootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Config file with profiles of these flags (default ~/.config/rabbitio/config.yaml)")
+	RootCmd.PersistentFlags().StringVar(&profile, "profile", "", "Profile of the config file to set the flags not given from, instead of its default profile")
+	RootCmd.PersistentFlags().StringVar(&passwordFile, "password-file", "", "File with the password of the user in the URI, instead of putting it in the URI")
+	RootCmd.PersistentFlags().StringVar(&tlsSettings.CA, "tls-ca", "", "PEM file with the CA certificates to verify RabbitMQ with on amqps:// instead of the system roots")
+	RootCmd.PersistentFlags().StringVar(&tlsSettings.Cert, "tls-cert", "", "PEM file with a client certificate, authenticating with EXTERNAL when the URI has no user")
+	RootCmd.PersistentFlags().StringVar(&tlsSettings.Key, "tls-key", "", "PEM file with the key of the client certificate")
+	RootCmd.PersistentFlags().StringVar(&tlsSettings.ServerName, "tls-server-name", "", "Name to verify the certificate of RabbitMQ with instead of the host of the URI")
+	RootCmd.PersistentFlags().BoolVar(&tlsSettings.InsecureSkipVerify, "tls-insecure-skip-verify", false, "Do not verify the certificate of RabbitMQ, for testing only")
+}
+
+// configure sets the root flags not given on the command line from their
+// RABBITIO_ environment variables, and then from the profile of the config
+// file. The password of the --password-file is added to the URI, and the
+// passwords of the URIs are masked in the logs
+func configure(flags *pflag.FlagSet) error {
+	if err := config.Apply(flags, config.Environment(flags, os.LookupEnv)); err != nil {
+		return err
+	}
+
+	path := configPath
+	if path == "" {
+		path = config.DefaultPath()
+	}
+	c, err := config.Load(path)
+	switch {
+	case os.IsNotExist(err) && configPath == "" && profile == "":
+		c = &config.Config{}
+	case err != nil:
+		return err
+	}
+	settings, err := c.Settings(profile)
+	if err != nil {
+		return err
+	}
+	if err := config.Apply(flags, settings); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	if passwordFile != "" {
+		password, err := config.ReadPassword(passwordFile)
+		if err != nil {
+			return err
+		}
+		if uri, err = rmq.WithPassword(uri, password); err != nil {
+			return err
+		}
+	}
+	stderr = config.Mask(os.Stderr, rmq.Password(uri), rmq.Password(targetURI))
+	log.SetOutput(stderr)
+
+	if settings != nil {
+		name := profile
+		if name == "" {
+			name = c.Profile
+		}
+		log.Printf("Using profile %s of %s", name, path)
+	}
+	return nil
+}
+
+// parseFilter parses the --filter expression, nil when not set
+func parseFilter() (*filter.Filter, error) {
+	if filterExpression == "" {
+		return nil, nil
+	}
+	f, err := filter.Parse(filterExpression)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Filtering messages on: %s", f)
+	return f, nil
+}
+
+// parseRedactor parses the --redact rules and the --redact-file, nil when
+// neither is set. The key of hash rules is --redact-key, or its environment
+// variable
+func parseRedactor() (*redact.Redactor, error) {
+	rules := redactRules
+	if redactFile != "" {
+		b, err := ioutil.ReadFile(redactFile)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, string(b))
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	key := redactKey
+	if key == "" {
+		key = os.Getenv(config.EnvVar("redact-key"))
+	}
+	rd, err := redact.Parse(rules, []byte(key))
+	if errors.Is(err, redact.ErrKey) {
+		return nil, fmt.Errorf("%w, set --redact-key or %s", err, config.EnvVar("redact-key"))
+	} else if err != nil {
+		return nil, err
+	}
+	for _, r := range rd.Rules() {
+		log.Printf("Redacting messages with: %s", r)
+	}
+	return rd, nil
+}
+
+// consumerPrefetch returns the prefetch needed by the tarball writers to fill
+// their batches, as the messages are only acked once the batch is written,
+// and to hold this number of messages not matching a filter on top of them.
+// RabbitMQ limits the prefetch to rmq.MaxPrefetch, larger batches would never fill
+func consumerPrefetch(writers, held int) (int, error) {
+	need := batchSize*writers + held
+	if need > rmq.MaxPrefetch {
+		return 0, fmt.Errorf("batches of %d messages for %d writers need a prefetch of %d, RabbitMQ allows at most %d, use a smaller --batch",
+			batchSize, writers, need, rmq.MaxPrefetch)
+	}
+	if prefetch > 0 && prefetch < need {
+		log.Printf("Raising prefetch from %d to %d to fill batches of %d messages", prefetch, need, batchSize)
+		return need, nil
+	}
+	return prefetch, nil
 }
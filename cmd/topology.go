@@ -0,0 +1,135 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/pflag"
+	"github.com/streadway/amqp"
+)
+
+var (
+	declare              bool
+	declareFrom          string
+	exchangeType         string
+	durable              bool
+	queueType            string
+	messageTTL           time.Duration
+	deadLetterExchange   string
+	deadLetterRoutingKey string
+	queueArgs            []string
+	bindings             []string
+)
+
+// topologyFlags adds the flags declaring the exchange and queue of in and out
+func topologyFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&declare, "declare", false, "Declare the exchange and queue when missing, and bind the queue to the exchange")
+	flags.StringVar(&exchangeType, "exchange-type", amqp.ExchangeTopic, "Type of the declared exchange: direct, fanout, topic or headers")
+	flags.BoolVar(&durable, "durable", true, "Declare a durable exchange and queue, --durable=false for transient ones")
+	flags.StringVar(&queueType, "queue-type", "", "Type of the declared queue: classic, quorum or stream")
+	flags.DurationVar(&messageTTL, "message-ttl", 0, "Time to live of the messages in the declared queue, e.g. 24h")
+	flags.StringVar(&deadLetterExchange, "dead-letter-exchange", "", "Exchange the declared queue dead-letters messages to")
+	flags.StringVar(&deadLetterRoutingKey, "dead-letter-routing-key", "", "Routing key of the messages dead-lettered by the declared queue")
+	flags.StringArrayVar(&queueArgs, "queue-arg", nil, "Argument of the declared queue like x-max-length=10000, repeat for more")
+	flags.StringArrayVar(&bindings, "bind", nil, "Routing key binding the declared queue to the exchange, repeat for more, defaults to --routingkey")
+}
+
+// parseTopology returns the topology to declare with --declare, or with
+// --declare-from the topology recorded by the latest run of a backup that
+// declared one, which also names the exchange and queue when not given. Nil
+// without either
+func parseTopology() (*rmq.Topology, error) {
+	if declareFrom != "" {
+		m, err := file.ReadManifest(declareFrom)
+		if err != nil {
+			return nil, err
+		}
+		var run *file.ManifestRun
+		for i := len(m.Runs) - 1; i >= 0 && run == nil; i-- {
+			if m.Runs[i].Topology != nil {
+				run = &m.Runs[i]
+			}
+		}
+		if run == nil {
+			return nil, fmt.Errorf("the manifest of %s records no topology, back up with out --declare to record it", declareFrom)
+		}
+		if exchange == "" {
+			exchange = run.Exchange
+		}
+		if queue == "" {
+			queue = run.Queue
+		}
+		log.Printf("Declaring the topology of the backup in %s recorded by run %s", declareFrom, run.ID)
+		return run.Topology, run.Topology.Validate()
+	}
+	if !declare {
+		return nil, nil
+	}
+
+	args := amqp.Table{}
+	for _, a := range queueArgs {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid queue argument %q, expected name=value", a)
+		}
+		args[kv[0]] = argument(kv[1])
+	}
+	if queueType != "" {
+		args["x-queue-type"] = queueType
+	}
+	if messageTTL > 0 {
+		args["x-message-ttl"] = messageTTL.Milliseconds()
+	}
+	if deadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = deadLetterExchange
+	}
+	if deadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = deadLetterRoutingKey
+	}
+	if len(args) == 0 {
+		args = nil
+	}
+	keys := bindings
+	if len(keys) == 0 {
+		keys = []string{routingKey}
+	}
+
+	t := &rmq.Topology{
+		ExchangeType: exchangeType,
+		Durable:      durable,
+		QueueArgs:    args,
+		Bindings:     keys,
+	}
+	return t, t.Validate()
+}
+
+// argument returns the value of a queue argument as an integer or boolean
+// when it is one, else as a string
+func argument(v string) interface{} {
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return v
+}
@@ -0,0 +1,86 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/meltwater/rabbitio/file"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyDirectory string
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verifies the tarballs in a directory against its manifest",
+	Long: `Checks the size and SHA-256 of every tarball listed in the manifest.json
+	written by out, and reports missing, extra or corrupt tarballs.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		v, err := file.Verify(verifyDirectory)
+		if err != nil {
+			return err
+		}
+
+		m := v.Manifest
+		log.Printf("Manifest written by rabbitio %s", m.Version)
+		tarballs := make(map[string]int)
+		for _, f := range m.Files {
+			tarballs[f.Run]++
+		}
+		for i := range m.Runs {
+			if r := &m.Runs[i]; tarballs[r.ID] > 0 {
+				log.Printf("Run %s of %s queue %q on exchange %q: %d tarballs%s", r.ID, r.URI, r.Queue, r.Exchange, tarballs[r.ID], describeRun(r))
+			}
+		}
+		for _, name := range v.Missing {
+			log.Printf("Missing: %s", name)
+		}
+		for _, c := range v.Corrupt {
+			log.Printf("Corrupt: %s: %s", c.Name, c.Reason)
+		}
+		for _, name := range v.Extra {
+			log.Printf("Extra: %s is not in the manifest", name)
+		}
+		log.Printf("Verified %d of %d tarballs", len(v.Valid), len(m.Files))
+		return v.Err()
+	},
+}
+
+// describeRun returns the recipients and redactions of a run to log after it
+func describeRun(r *file.ManifestRun) string {
+	var s string
+	if len(r.Recipients) > 0 {
+		s += fmt.Sprintf(", encrypted to %s", strings.Join(r.Recipients, ","))
+	}
+	if len(r.Redactions) > 0 {
+		s += fmt.Sprintf(", redacted with %d rules", len(r.Redactions))
+	}
+	if r.RedactionKey != "" {
+		s += fmt.Sprintf(" and key %s", r.RedactionKey)
+	}
+	return s
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyDirectory, "directory", "d", ".", "Directory with the tarballs and manifest.json to verify")
+}
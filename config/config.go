@@ -0,0 +1,131 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables setting flags
+const EnvPrefix = "RABBITIO_"
+
+// Config is a file with named profiles of flags, like
+//
+//	profile: prod-eu
+//	profiles:
+//	  prod-eu:
+//	    uri: amqps://backup@rabbit-eu.example.com/
+//	    password-file: ~/.rabbitio/prod-eu.password
+//	    tls-ca: /etc/ssl/certs/private-ca.pem
+type Config struct {
+	// Profile is used when no profile is asked for
+	Profile  string                            `yaml:"profile"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// DefaultPath returns the path of the config file in the user config
+// directory, like ~/.config/rabbitio/config.yaml
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "rabbitio", "config.yaml")
+}
+
+// Load reads the config file
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Settings returns the flags of the profile, or of the default profile when
+// name is empty. Without a default profile no flags are set
+func (c *Config) Settings(name string) (map[string]string, error) {
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in the config, expected one of %s", name, strings.Join(c.names(), ", "))
+	}
+	settings := make(map[string]string, len(profile))
+	for flag, v := range profile {
+		settings[flag] = fmt.Sprint(v)
+	}
+	return settings, nil
+}
+
+// names returns the sorted names of the profiles
+func (c *Config) names() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EnvVar returns the environment variable of a flag, like RABBITIO_TLS_CA
+// for --tls-ca
+func EnvVar(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Environment returns the flags set by environment variables
+func Environment(flags *pflag.FlagSet, lookup func(string) (string, bool)) map[string]string {
+	settings := make(map[string]string)
+	flags.VisitAll(func(f *pflag.Flag) {
+		if v, ok := lookup(EnvVar(f.Name)); ok {
+			settings[f.Name] = v
+		}
+	})
+	return settings
+}
+
+// Apply sets the flags not given on the command line
+func Apply(flags *pflag.FlagSet, settings map[string]string) error {
+	for name, v := range settings {
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if f.Changed {
+			continue
+		}
+		if err := flags.Set(name, v); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
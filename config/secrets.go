@@ -0,0 +1,75 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadPassword reads a password from the first line of a file, a path
+// starting with ~/ is in the home directory
+func ReadPassword(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", fmt.Errorf("no password in %s", path)
+	}
+	return password, nil
+}
+
+// maskingWriter replaces the secrets in everything written
+type maskingWriter struct {
+	w        io.Writer
+	replacer *strings.Replacer
+}
+
+// Mask returns a writer replacing the secrets with xxxxx, like the password
+// in URIs of the log lines. Writes are masked one at a time, so a secret
+// split over two writes is not masked
+func Mask(w io.Writer, secrets ...string) io.Writer {
+	var pairs []string
+	for _, s := range secrets {
+		// the default password of RabbitMQ is no secret, and would mask the user
+		if s != "" && s != "guest" {
+			pairs = append(pairs, s, "xxxxx")
+		}
+	}
+	if len(pairs) == 0 {
+		return w
+	}
+	return &maskingWriter{w: w, replacer: strings.NewReplacer(pairs...)}
+}
+
+func (m *maskingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(m.w, m.replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,171 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Codecs of the tarballs
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	LZ4  = "lz4"
+	None = "none"
+)
+
+// magic bytes at the start of the compressed tarballs
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	tarMagic  = []byte("ustar")
+)
+
+// Compression is the codec and level the tarballs are written with
+type Compression struct {
+	Codec string
+	Level int
+}
+
+// DefaultCompression is the best gzip compression
+var DefaultCompression = Compression{Codec: Gzip, Level: gzip.BestCompression}
+
+// ParseCompression parses a codec with an optional level, like gzip:6, zstd:3,
+// lz4 or none
+func ParseCompression(s string) (Compression, error) {
+	codec, level := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		codec, level = s[:i], s[i+1:]
+	}
+
+	c := Compression{Codec: strings.ToLower(codec)}
+	min, max := 0, 0
+	switch c.Codec {
+	case Gzip:
+		c.Level, min, max = gzip.BestCompression, gzip.BestSpeed, gzip.BestCompression
+	case Zstd:
+		c.Level, min, max = 3, 1, 22
+	case LZ4:
+		c.Level, min, max = 0, 0, 9
+	case None:
+		if level != "" {
+			return c, fmt.Errorf("compression none has no level")
+		}
+		return c, nil
+	default:
+		return c, fmt.Errorf("unknown compression %q, expected gzip, zstd, lz4 or none", codec)
+	}
+
+	if level != "" {
+		l, err := strconv.Atoi(level)
+		if err != nil || l < min || l > max {
+			return c, fmt.Errorf("invalid %s level %q, expected %d to %d", c.Codec, level, min, max)
+		}
+		c.Level = l
+	}
+	return c, nil
+}
+
+// String returns the codec and level
+func (c Compression) String() string {
+	if c.Codec == None {
+		return None
+	}
+	return fmt.Sprintf("%s:%d", c.Codec, c.Level)
+}
+
+// Extension returns the file extension of tarballs with the compression
+func (c Compression) Extension() string {
+	switch c.Codec {
+	case Zstd:
+		return ".tar.zst"
+	case LZ4:
+		return ".tar.lz4"
+	case None:
+		return ".tar"
+	}
+	return ".tgz"
+}
+
+// compressor compresses the tar stream, flushing makes everything written so
+// far readable
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// writer returns a compressor writing to w
+func (c Compression) writer(w io.Writer) (compressor, error) {
+	switch c.Codec {
+	case Gzip:
+		return gzip.NewWriterLevel(w, c.Level)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+	case LZ4:
+		zw := lz4.NewWriter(w)
+		zw.Header.CompressionLevel = c.Level
+		return zw, nil
+	case None:
+		return nopCompressor{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c.Codec)
+}
+
+// nopCompressor writes the tar stream uncompressed
+type nopCompressor struct {
+	io.Writer
+}
+
+func (nopCompressor) Flush() error { return nil }
+func (nopCompressor) Close() error { return nil }
+
+// decompress detects the codec of the tarball from its magic bytes and
+// returns the uncompressed tar stream
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	head, err := r.Peek(len(tarMagic) + 257)
+	if len(head) == 0 {
+		if err == io.EOF {
+			err = errors.New("empty tarball")
+		}
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(head, lz4Magic):
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case len(head) > 257 && bytes.HasPrefix(head[257:], tarMagic):
+		return io.NopCloser(r), nil
+	}
+	return nil, errors.New("unknown tarball format, expected a gzip, zstd, lz4 or uncompressed tarball")
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Compression
+	}{
+		{"gzip", Compression{Codec: Gzip, Level: 9}},
+		{"gzip:1", Compression{Codec: Gzip, Level: 1}},
+		{"zstd", Compression{Codec: Zstd, Level: 3}},
+		{"ZSTD:19", Compression{Codec: Zstd, Level: 19}},
+		{"lz4", Compression{Codec: LZ4}},
+		{"none", Compression{Codec: None}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCompression(tt.in)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, c, tt.in)
+	}
+
+	for _, in := range []string{"gzip:0", "gzip:fast", "zstd:23", "none:1", "bzip2", ""} {
+		_, err := ParseCompression(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestCompression_RoundTrip(t *testing.T) {
+	for _, codec := range []string{"gzip:1", "zstd", "lz4", "none"} {
+		fs = afero.NewMemMapFs()
+		fs.MkdirAll("/data", 0755)
+		c, _ := ParseCompression(codec)
+
+		tarball, _ := NewTarballBuilder(2, c)
+		ch := make(chan rmq.Message, 2)
+		ch <- rmq.Message{Body: []byte("first"), RoutingKey: "rk"}
+		ch <- rmq.Message{Body: []byte("second"), RoutingKey: "rk"}
+		close(ch)
+		err := tarball.Pack(ch, "/data", make(chan rmq.Verify, 1))
+		assert.NoError(t, err, codec)
+
+		name := "/data/1_messages_2" + c.Extension()
+		fh, err := fs.Open(name)
+		assert.NoError(t, err, "should name the tarball %s", name)
+		if err != nil {
+			continue
+		}
+
+		messages := make(chan rmq.Message, 2)
+		n, _, err := UnPack(new(sync.WaitGroup), fh, messages, nil)
+
+		assert.NoError(t, err, codec)
+		assert.Equal(t, 2, n, codec)
+		assert.Equal(t, "first", string((<-messages).Body), codec)
+		assert.Equal(t, "rk", (<-messages).RoutingKey, codec)
+	}
+}
+
+func TestUnPack_UnknownFormat(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	afero.WriteFile(fs, "/data.txt", []byte("not a tarball"), 0644)
+	fh, _ := fs.Open("/data.txt")
+
+	_, _, err := UnPack(new(sync.WaitGroup), fh, make(chan rmq.Message), nil)
+
+	assert.Error(t, err, "should not unpack a file that is not a tarball")
+}
@@ -0,0 +1,138 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/afero"
+)
+
+// ageExtension is added to the names of encrypted tarballs
+const ageExtension = ".age"
+
+// ageMagic starts every age encrypted file
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+// ParseRecipients parses age X25519 public keys, given as age1... or as a
+// file with a key on every line, empty lines and # comments are skipped
+func ParseRecipients(values []string) ([]*age.X25519Recipient, error) {
+	var recipients []*age.X25519Recipient
+	for _, v := range values {
+		keys := []string{v}
+		if !strings.HasPrefix(v, "age1") {
+			b, err := afero.ReadFile(fs, v)
+			if err != nil {
+				return nil, fmt.Errorf("recipient %s is neither an age public key nor a file: %s", v, err)
+			}
+			keys = strings.Split(string(b), "\n")
+		}
+		for _, k := range keys {
+			k = strings.TrimSpace(k)
+			if k == "" || strings.HasPrefix(k, "#") {
+				continue
+			}
+			r, err := age.ParseX25519Recipient(k)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients, nil
+}
+
+// ParseIdentities reads the age identity files
+func ParseIdentities(paths []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, p := range paths {
+		b, err := afero.ReadFile(fs, p)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := age.ParseIdentities(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %s", p, err)
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
+
+// recipients returns the recipients as age.Recipient
+func recipients(rs []*age.X25519Recipient) []age.Recipient {
+	out := make([]age.Recipient, len(rs))
+	for i, r := range rs {
+		out[i] = r
+	}
+	return out
+}
+
+// isEncrypted returns true when r starts with an age header
+func isEncrypted(r *bufio.Reader) bool {
+	b, _ := r.Peek(len(ageMagic))
+	return bytes.Equal(b, ageMagic)
+}
+
+// decrypt returns the decrypted r when it is encrypted, or r
+func decrypt(name string, r *bufio.Reader, identities []age.Identity) (io.Reader, error) {
+	if !isEncrypted(r) {
+		return r, nil
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("%s is encrypted and no identity was given", name)
+	}
+	d, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("can not decrypt %s: %s", name, err)
+	}
+	return d, nil
+}
+
+// CheckIdentities returns an error when any of the encrypted files can not be
+// decrypted with the Identities, before any message is sent. Standard input
+// is checked when it is read
+func (p *Path) CheckIdentities() error {
+	var n int
+	for _, file := range p.queue {
+		if file == Stdin {
+			continue
+		}
+		fh, err := fs.Open(file)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(fh)
+		encrypted := isEncrypted(r)
+		_, err = decrypt(file, r, p.Identities)
+		fh.Close()
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("Checked the identities of %d encrypted tarballs", n)
+	}
+	return nil
+}
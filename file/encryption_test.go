@@ -0,0 +1,133 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// encrypted writes the messages to tarballs of two messages encrypted to the identity
+func encrypted(t *testing.T, id *age.X25519Identity, messages int) {
+	p, _ := NewOutput("/data", 2)
+	p.Names = &Namer{Template: "{seq}_messages_{count}"}
+	p.Manifest = &Manifest{Queue: "myqueue"}
+	p.Recipients = []*age.X25519Recipient{id.Recipient()}
+
+	ch := make(chan rmq.Message, messages)
+	for i := 0; i < messages; i++ {
+		ch <- rmq.Message{Body: []byte("mymessage")}
+	}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, messages)))
+}
+
+func TestPath_ReceiveEncrypted(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	id, _ := age.GenerateX25519Identity()
+	encrypted(t, id, 3)
+
+	b, _ := afero.ReadFile(fs, "/data/1_messages_2.tgz.age")
+	assert.True(t, bytes.HasPrefix(b, ageMagic), "should encrypt the tarball")
+	assert.NotContains(t, string(b), "mymessage")
+
+	m, _ := ReadManifest("/data")
+	assert.Equal(t, []string{id.Recipient().String()}, m.Runs[0].Recipients)
+	v, _ := Verify("/data")
+	assert.NoError(t, v.Err())
+
+	p, _ := NewInput("/data")
+	p.Wg = new(sync.WaitGroup)
+	p.Identities = []age.Identity{id}
+	assert.NoError(t, p.CheckIdentities())
+	messages := make(chan rmq.Message, 3)
+	go func() {
+		for range messages {
+			p.Wg.Done()
+		}
+	}()
+	assert.NoError(t, p.Send(messages), "should decrypt the tarballs")
+}
+
+func TestPath_CheckIdentities(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	id, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	encrypted(t, id, 1)
+
+	p, _ := NewInput("/data")
+	assert.Error(t, p.CheckIdentities(), "should refuse encrypted tarballs without identity")
+
+	p.Identities = []age.Identity{other}
+	assert.Error(t, p.CheckIdentities(), "should refuse a wrong identity")
+}
+
+func TestPath_ReceiveEncryptedStream(t *testing.T) {
+	id, _ := age.GenerateX25519Identity()
+	var buf bytes.Buffer
+	p := NewStreamOutput(&buf, 1)
+	p.Recipients = []*age.X25519Recipient{id.Recipient()}
+
+	ch := make(chan rmq.Message, 2)
+	ch <- rmq.Message{Body: []byte("first")}
+	ch <- rmq.Message{Body: []byte("second")}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 2)))
+
+	r, err := decrypt("stream", bufio.NewReader(&buf), []age.Identity{id})
+	assert.NoError(t, err)
+	messages := make(chan rmq.Message, 2)
+	n, _, err := unpack(new(sync.WaitGroup), "stream", r, messages, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestParseRecipients(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	first, _ := age.GenerateX25519Identity()
+	second, _ := age.GenerateX25519Identity()
+	afero.WriteFile(fs, "/keys.txt", []byte("# backup keys\n"+second.Recipient().String()+"\n\n"), 0644)
+
+	rs, err := ParseRecipients([]string{first.Recipient().String(), "/keys.txt"})
+	assert.NoError(t, err)
+	assert.Len(t, rs, 2)
+	assert.Equal(t, second.Recipient().String(), rs[1].String())
+
+	_, err = ParseRecipients([]string{"/missing.txt"})
+	assert.Error(t, err)
+	_, err = ParseRecipients([]string{"age1invalid"})
+	assert.Error(t, err)
+}
+
+func TestParseIdentities(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	id, _ := age.GenerateX25519Identity()
+	afero.WriteFile(fs, "/key.txt", []byte("# created: 2018-03-15\n"+id.String()+"\n"), 0644)
+
+	ids, err := ParseIdentities([]string{"/key.txt"})
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+
+	afero.WriteFile(fs, "/invalid.txt", []byte("not a key"), 0644)
+	_, err = ParseIdentities([]string{"/invalid.txt"})
+	assert.Error(t, err)
+}
@@ -15,11 +15,18 @@
 package file
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"filippo.io/age"
+	"github.com/meltwater/rabbitio/filter"
+	"github.com/meltwater/rabbitio/redact"
 	"github.com/meltwater/rabbitio/rmq"
 	"github.com/spf13/afero"
 )
@@ -33,67 +40,130 @@ type Path struct {
 	batchSize int
 	queue     []string
 	Wg        *sync.WaitGroup
+	// Filter skips the messages not matching when sending
+	Filter *filter.Filter
+	// AckEach acks every received message by itself, needed when messages
+	// on the same channel are not all received by this Path
+	AckEach bool
+	// Compression of the written tarballs
+	Compression Compression
+	// MaxBytes and MaxAge rotate tarballs before batchSize messages, by the
+	// size of the message bodies or the age of the first message
+	MaxBytes int64
+	MaxAge   time.Duration
+	// Manifest is written to the directory with the tarballs, when set
+	Manifest *Manifest
+	// Workers is the number of files decompressed in parallel when sending
+	Workers int
+	// Recipients encrypt the written tarballs, and Identities decrypt the
+	// encrypted tarballs when sending
+	Recipients []*age.X25519Recipient
+	Identities []age.Identity
+	// Redactor redacts the messages before they are written, when set
+	Redactor *redact.Redactor
+	// Names names the written tarballs and Overwrite replaces existing files
+	// with the same name instead of failing
+	Names     *Namer
+	Overwrite bool
+	stream    io.Writer
 }
 
-// NewInput returns a *Path with a queue of files paths, all files in a directory
+// Stdin is the path reading tarballs from standard input
+const Stdin = "-"
+
+// NewInput returns a *Path with a queue of files paths, all tarballs in a
+// directory, the tarballs matching a glob pattern, or standard input for the path -
 func NewInput(path string) (*Path, error) {
-	fi, err := fs.Stat(path)
+	return NewInputs([]string{path}, false)
+}
+
+// temporary files of tarballs being written
+const (
+	tempPrefix = ".rabbitio-"
+	tempSuffix = ".tmp"
+)
+
+// maxNameTries is the number of names tried for a tarball before giving up
+const maxNameTries = 1000
+
+// renameFile renames the completed temporary file to name and ext in dir and
+// returns the name it was written to and its size. An existing file is only
+// replaced with overwrite, otherwise the name is claimed by creating the file
+// exclusively and a number is added to the name while it is taken, so a file
+// created by another run in the meantime is never replaced
+func renameFile(tmp, dir, name, ext string, overwrite bool) (string, int64, error) {
+	fi, err := fs.Stat(tmp)
 	if err != nil {
-		// log.Fatalln(err)
-		return nil, err
+		return "", 0, err
 	}
-
-	q := []string{}
-	switch mode := fi.Mode(); {
-	case mode.IsDir():
-		files, err := afero.ReadDir(fs, path)
-		if err != nil {
-			return nil, err
-			//	log.Fatalf("Couldn't get directory or file: %s", err)
+	file := name + ext
+	if !overwrite {
+		if file, err = claimName(dir, name, ext); err != nil {
+			fs.Remove(tmp)
+			return "", 0, err
 		}
-		log.Printf("Found %d file(s) in %s", len(files), path)
-		for _, f := range files {
-			q = append(q, filepath.Join(path, f.Name()))
+	}
+	filePath := filepath.Join(dir, file)
+	if err := fs.Rename(tmp, filePath); err != nil {
+		if !overwrite {
+			fs.Remove(filePath)
 		}
-	case mode.IsRegular():
-		q = append(q, path)
+		return "", 0, err
 	}
-
-	return &Path{queue: q}, nil
+	log.Printf("Wrote %d bytes to %s", fi.Size(), filePath)
+	return file, fi.Size(), nil
 }
 
-func writeFile(b []byte, dir, file string) error {
-	filePath := filepath.Join(dir, file)
-	err := afero.WriteFile(fs, filePath, b, 0644)
-	if err != nil {
-		return err
+// claimName creates the first free one of name, name_2, name_3 and so on
+// with ext in dir exclusively and returns it
+func claimName(dir, name, ext string) (string, error) {
+	file := name + ext
+	for i := 2; i <= maxNameTries+1; i++ {
+		claim, err := fs.OpenFile(filepath.Join(dir, file), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, claim.Close()
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		log.Printf("%s already exists, trying another name", filepath.Join(dir, file))
+		file = fmt.Sprintf("%s_%d%s", name, i, ext)
 	}
-	log.Printf("Wrote %d bytes to %s", len(b), filePath)
-	return nil
+	return "", fmt.Errorf("no free name for %s%s in %s after %d tries", name, ext, dir, maxNameTries)
 }
 
-// Send delivers messages to the channel
+// Send delivers messages to the channel, in the order of the files. With
+// Workers the next files are decompressed in parallel while the messages of
+// the current file are sent
 func (p *Path) Send(messages chan rmq.Message) error {
 	var num int
+	stop := make(chan struct{})
+	files := p.unpack(cap(messages), stop)
 
 	// loop over the queued up files
-	for _, file := range p.queue {
-		// open file from the queue
-		fh, err := fs.Open(file)
-		if err != nil {
-			return err
-			// log.Fatalf("failed to open file: %s", err)
+	for u := range files {
+		for m := range u.messages {
+			messages <- m
 		}
-		// and clean up afterwards
-		defer fh.Close()
-
-		tarNum, err := UnPack(p.Wg, fh, messages)
-		if err != nil {
-			return err
+		r := <-u.result
+		u.release()
+		if r.err != nil {
+			// stop unpacking and drop the messages of the started files
+			close(stop)
+			for u := range files {
+				for range u.messages {
+				}
+				u.release()
+			}
+			return r.err
 			//log.Fatalf("Failed to unpack: %s ", err)
 		}
-		log.Printf("Extracted %d Messages from tarball: %s", tarNum, file)
-		num = num + tarNum
+		if r.skipped > 0 {
+			log.Printf("Extracted %d Messages from tarball: %s, skipped %d not matching the filter", r.n, u.file, r.skipped)
+		} else {
+			log.Printf("Extracted %d Messages from tarball: %s", r.n, u.file)
+		}
+		num = num + r.n
 	}
 
 	p.Wg.Wait()
@@ -103,12 +173,84 @@ func (p *Path) Send(messages chan rmq.Message) error {
 	return nil
 }
 
+// unpacking is a file being unpacked to its messages
+type unpacking struct {
+	file     string
+	messages chan rmq.Message
+	result   chan unpacked
+	release  func()
+}
+
+// unpacked is the result of unpacking a file
+type unpacked struct {
+	n, skipped int
+	err        error
+}
+
+// unpack starts unpacking the files in order, up to Workers files at a time
+// with size messages buffered for each, until stop is closed. A file counts
+// until it is released after its messages are sent
+func (p *Path) unpack(size int, stop chan struct{}) <-chan unpacking {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	running := make(chan struct{}, workers)
+	files := make(chan unpacking, workers)
+
+	go func() {
+		defer close(files)
+		for _, file := range p.queue {
+			select {
+			case running <- struct{}{}:
+			case <-stop:
+				return
+			}
+			u := unpacking{
+				file:     file,
+				messages: make(chan rmq.Message, size),
+				result:   make(chan unpacked, 1),
+				release:  func() { <-running },
+			}
+			go func() {
+				n, skipped, err := p.unpackFile(u.file, u.messages)
+				close(u.messages)
+				u.result <- unpacked{n, skipped, err}
+			}()
+			files <- u
+		}
+	}()
+	return files
+}
+
+// unpackFile opens the file, or standard input, and unpacks its messages
+func (p *Path) unpackFile(file string, messages chan rmq.Message) (n, skipped int, err error) {
+	// open file from the queue
+	var fh afero.File = os.Stdin
+	if file != Stdin {
+		fh, err = fs.Open(file)
+		if err != nil {
+			return 0, 0, err
+			// log.Fatalf("failed to open file: %s", err)
+		}
+		// and clean up afterwards
+		defer fh.Close()
+	}
+	r, err := decrypt(fh.Name(), bufio.NewReader(fh), p.Identities)
+	if err != nil {
+		return 0, 0, err
+	}
+	return unpack(p.Wg, fh.Name(), r, messages, p.Filter)
+}
+
 // NewOutput creates a Path to output files in from RabbitMQ
 func NewOutput(path string, batchSize int) (*Path, error) {
 
 	p := &Path{
-		name:      path,
-		batchSize: batchSize,
+		name:        path,
+		batchSize:   batchSize,
+		Compression: DefaultCompression,
+		Names:       &Namer{Template: DefaultNameTemplate, Run: NewRunID()},
 	}
 
 	if err := p.create(); err != nil {
@@ -118,6 +260,15 @@ func NewOutput(path string, batchSize int) (*Path, error) {
 	return p, nil
 }
 
+// NewStreamOutput creates a Path writing one continuous compressed tar stream to w
+func NewStreamOutput(w io.Writer, batchSize int) *Path {
+	return &Path{
+		batchSize:   batchSize,
+		Compression: DefaultCompression,
+		stream:      w,
+	}
+}
+
 // Create creates the target directory if missing
 func (p *Path) create() error {
 	if _, err := fs.Stat(p.name); os.IsNotExist(err) {
@@ -133,11 +284,64 @@ func (p *Path) create() error {
 // Receive will handle messages and save to path
 func (p *Path) Receive(messages chan rmq.Message, verify chan rmq.Verify) error {
 
-	// create new TarballBuilder
-	builder, err := NewTarballBuilder(p.batchSize)
+	// create new TarballBuilder, the stream is encrypted as a whole
+	var builder *TarballBuilder
+	var enc io.WriteCloser
+	var err error
+	if p.stream != nil {
+		stream := p.stream
+		if len(p.Recipients) > 0 {
+			if enc, err = age.Encrypt(stream, recipients(p.Recipients)...); err != nil {
+				close(verify)
+				return err
+			}
+			stream = enc
+		}
+		builder, err = NewStreamBuilder(p.batchSize, p.Compression, stream)
+	} else {
+		builder, err = NewTarballBuilder(p.batchSize, p.Compression)
+	}
 	if err != nil {
+		close(verify)
 		return err
 	}
+	builder.ackEach = p.AckEach
+	builder.redactor = p.Redactor
+	builder.maxBytes = p.MaxBytes
+	builder.maxAge = p.MaxAge
+	if p.stream == nil {
+		builder.names = p.Names
+		builder.overwrite = p.Overwrite
+		builder.manifest = p.Manifest
+		builder.recipients = recipients(p.Recipients)
+	}
+	if builder.manifest != nil {
+		builder.manifest.Recipients = nil
+		for _, r := range p.Recipients {
+			builder.manifest.Recipients = append(builder.manifest.Recipients, r.String())
+		}
+		builder.manifest.Redactions = p.Redactor.Rules()
+		builder.manifest.RedactionKey = p.Redactor.KeyID()
+		var run string
+		if p.Names != nil {
+			run = p.Names.Run
+		}
+		if err := builder.manifest.keep(p.name, run); err != nil {
+			close(verify)
+			return err
+		}
+	}
 
-	return builder.Pack(messages, p.name, verify)
+	if err := builder.Pack(messages, p.name, verify); err != nil {
+		return err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	if builder.manifest != nil {
+		return builder.manifest.finish(p.name)
+	}
+	return nil
 }
@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"log"
 	"sync"
 	"testing"
@@ -34,6 +35,7 @@ func TestNewInput(t *testing.T) {
 	fs.MkdirAll("datadir", 0755)
 	afero.WriteFile(fs, "datadir/file1.tgz", []byte("mymessage"), 0644)
 	afero.WriteFile(fs, "datadir/file2.tgz", []byte("mymessage"), 0644)
+	afero.WriteFile(fs, "datadir/.rabbitio-3f0e.tmp", []byte("mymessage"), 0644)
 	path, err := NewInput("datadir")
 
 	_, err2 := NewInput("datadir_notthere")
@@ -148,17 +150,124 @@ func TestPath_Send(t *testing.T) {
 	assert.NoError(noErr, "should return no error")
 }
 
-func TestWriteFile(t *testing.T) {
+func TestRenameFile(t *testing.T) {
 	assert := assert.New(t)
-	fs = afero.NewMemMapFs()
+	// exclusive creation needs a real file system
+	fs = afero.NewOsFs()
+	defer func() { fs = afero.NewMemMapFs() }()
+	dir := t.TempDir()
 
-	fs.MkdirAll("datadir", 0755)
-	myBytes := []byte("mydatawritten")
-	err := writeFile(myBytes, "datadir", "datafile")
+	afero.WriteFile(fs, dir+"/.rabbitio-1.tmp", []byte("mydatawritten"), 0644)
+	name, size, err := renameFile(dir+"/.rabbitio-1.tmp", dir, "datafile", ".tgz", false)
+	written, _ := afero.ReadFile(fs, dir+"/datafile.tgz")
+	tmp, _ := afero.Exists(fs, dir+"/.rabbitio-1.tmp")
 
-	fs = afero.NewReadOnlyFs(fs)
-	err2 := writeFile(myBytes, "datadir", "datafile")
+	_, _, err2 := renameFile(dir+"/.rabbitio-2.tmp", dir, "datafile2", ".tgz", false)
+
+	afero.WriteFile(fs, dir+"/.rabbitio-3.tmp", []byte("other"), 0644)
+	name3, _, err3 := renameFile(dir+"/.rabbitio-3.tmp", dir, "datafile", ".tgz", false)
+	kept, _ := afero.ReadFile(fs, dir+"/datafile.tgz")
+	other, _ := afero.ReadFile(fs, dir+"/datafile_2.tgz")
+
+	afero.WriteFile(fs, dir+"/.rabbitio-4.tmp", []byte("replaced"), 0644)
+	name4, _, err4 := renameFile(dir+"/.rabbitio-4.tmp", dir, "datafile", ".tgz", true)
+	replaced, _ := afero.ReadFile(fs, dir+"/datafile.tgz")
 
 	assert.Nil(err, "should return no error")
+	assert.Equal("datafile.tgz", name)
+	assert.Equal("mydatawritten", string(written))
+	assert.Equal(int64(13), size)
+	assert.False(tmp, "should not leave the temporary file")
 	assert.NotNil(err2, "should return error")
+	assert.NoError(err3)
+	assert.Equal("datafile_2.tgz", name3, "should add a number to a taken name")
+	assert.Equal("mydatawritten", string(kept), "should not overwrite an existing file")
+	assert.Equal("other", string(other))
+	assert.NoError(err4, "should overwrite with overwrite")
+	assert.Equal("datafile.tgz", name4)
+	assert.Equal("replaced", string(replaced))
+}
+
+func TestRenameFile_Concurrent(t *testing.T) {
+	// exclusive creation needs a real file system
+	fs = afero.NewOsFs()
+	defer func() { fs = afero.NewMemMapFs() }()
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	names := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		tmp := fmt.Sprintf("%s/.rabbitio-%d.tmp", dir, i)
+		afero.WriteFile(fs, tmp, []byte(tmp), 0644)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, _, err := renameFile(tmp, dir, "datafile", ".tgz", false)
+			assert.NoError(t, err)
+			names <- name
+		}()
+	}
+	wg.Wait()
+	close(names)
+
+	unique := make(map[string]bool)
+	for name := range names {
+		unique[name] = true
+	}
+	assert.Len(t, unique, 10, "should give every tarball its own name")
+	files, _ := afero.ReadDir(fs, dir)
+	assert.Len(t, files, 10, "should leave no temporary file behind")
+	for _, f := range files {
+		assert.True(t, unique[f.Name()], "should only write the returned names")
+		assert.NotZero(t, f.Size(), "should leave no empty placeholder behind")
+	}
+}
+
+func TestPath_SendWorkers(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+	for i := 1; i <= 5; i++ {
+		tarball, _ := NewTarballBuilder(3, DefaultCompression)
+		ch := make(chan rmq.Message, 3)
+		for j := 0; j < 3; j++ {
+			ch <- rmq.Message{Body: []byte(fmt.Sprintf("%d-%d", i, j))}
+		}
+		close(ch)
+		tarball.Pack(ch, fmt.Sprintf("/data/%d", i), make(chan rmq.Verify, 1))
+	}
+
+	path, _ := NewInputs([]string{"/data"}, true)
+	path.Wg = new(sync.WaitGroup)
+	path.Workers = 3
+	messages := make(chan rmq.Message, 1)
+	var bodies []string
+	done := make(chan struct{})
+	go func() {
+		for m := range messages {
+			bodies = append(bodies, string(m.Body))
+			path.Wg.Done()
+		}
+		close(done)
+	}()
+
+	assert.NoError(t, path.Send(messages))
+	<-done
+	assert.Len(t, bodies, 15)
+	for i, b := range bodies {
+		assert.Equal(t, fmt.Sprintf("%d-%d", i/3+1, i%3), b, "should send the files in order")
+	}
+}
+
+func TestPath_SendWorkersError(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+	afero.WriteFile(fs, "/data/1.tgz", tarball(), 0644)
+	afero.WriteFile(fs, "/data/2.tgz", []byte("not a tarball"), 0644)
+	afero.WriteFile(fs, "/data/3.tgz", tarball(), 0644)
+
+	path, _ := NewInput("/data")
+	path.Wg = new(sync.WaitGroup)
+	path.Workers = 2
+
+	assert.Error(t, path.Send(make(chan rmq.Message, 10)), "should return the error of the failed file")
 }
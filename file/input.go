@@ -0,0 +1,241 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// tarballExtensions are the file names recognised as tarballs in directories
+var tarballExtensions = []string{".tgz", ".tar.gz", ".tar.zst", ".tar.lz4", ".tar"}
+
+// NewInputs returns a *Path with a queue of the files, directories and glob
+// patterns in paths, where ** matches any number of directories. Directories
+// are read recursively with recursive, and the files of every path are
+// queued in natural order, so 2_messages_100.tgz comes before 10_messages_100.tgz
+func NewInputs(paths []string, recursive bool) (*Path, error) {
+	q := []string{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		files, err := expand(path, recursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				q = append(q, f)
+			}
+		}
+	}
+	if len(q) != 1 || q[0] != Stdin {
+		log.Printf("Found %d file(s) in %s", len(q), strings.Join(paths, ", "))
+	}
+	return &Path{queue: q}, nil
+}
+
+// expand returns the files of the path in natural order
+func expand(path string, recursive bool) ([]string, error) {
+	if path == Stdin {
+		return []string{Stdin}, nil
+	}
+
+	fi, err := fs.Stat(path)
+	if os.IsNotExist(err) && hasMeta(path) {
+		return glob(path, recursive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return list(path, recursive)
+	}
+	return []string{path}, nil
+}
+
+// list returns the tarballs in dir in natural order
+func list(dir string, recursive bool) ([]string, error) {
+	q := []string{}
+	err := walk(dir, func(path string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			if path != dir && !recursive {
+				log.Printf("Skipping directory %s, use --recursive to read it", path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isInput(path) {
+			q = append(q, path)
+		}
+		return nil
+	})
+	naturalSort(q)
+	return q, err
+}
+
+// glob returns the tarballs matching the pattern in natural order, and the
+// tarballs in the matching directories
+func glob(pattern string, recursive bool) ([]string, error) {
+	segments := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	for _, s := range segments {
+		if _, err := filepath.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+
+	// walk from the directory before the first segment with a pattern
+	n := 0
+	for n < len(segments)-1 && !hasMeta(segments[n]) {
+		n++
+	}
+	root := filepath.FromSlash(strings.Join(segments[:n], "/"))
+	switch {
+	case n == 0:
+		root = "."
+	case root == "":
+		root = string(filepath.Separator)
+	}
+
+	q := []string{}
+	err := walk(root, func(path string, fi os.FileInfo) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || !matchSegments(strings.Split(filepath.ToSlash(rel), "/"), segments[n:]) {
+			return nil
+		}
+		if !fi.IsDir() {
+			if isInput(path) {
+				q = append(q, path)
+			}
+			return nil
+		}
+		files, err := list(path, recursive)
+		q = append(q, files...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(q) == 0 {
+		return nil, fmt.Errorf("no tarballs match %s", pattern)
+	}
+	naturalSort(q)
+	return q, nil
+}
+
+// walk calls fn for all files and directories in root, skipping missing roots
+func walk(root string, fn func(path string, fi os.FileInfo) error) error {
+	return afero.Walk(fs, root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		return fn(path, fi)
+	})
+}
+
+// matchSegments matches the path segments of a name to the pattern, where
+// the segment ** matches zero or more segments
+func matchSegments(name, pattern []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(name[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], name[0])
+	return ok && matchSegments(name[1:], pattern[1:])
+}
+
+// hasMeta returns true for paths with glob pattern characters
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
+}
+
+// isInput returns true for tarballs, skipping the manifest and temporary
+// files silently and other files with a warning
+func isInput(path string) bool {
+	name := filepath.Base(path)
+	if name == ManifestName || isTemp(name) {
+		return false
+	}
+	name = strings.TrimSuffix(name, ageExtension)
+	for _, ext := range tarballExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	log.Printf("Skipping %s, not a tarball", path)
+	return false
+}
+
+// naturalSort sorts the names with numbers in numerical order
+func naturalSort(names []string) {
+	sort.SliceStable(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+}
+
+// naturalLess compares runs of digits by their value and other runs by bytes
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := chunk(a), chunk(b)
+		a, b = a[len(ca):], b[len(cb):]
+		if ca == cb {
+			continue
+		}
+		if isDigit(ca[0]) && isDigit(cb[0]) {
+			na, nb := strings.TrimLeft(ca, "0"), strings.TrimLeft(cb, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+		}
+		return ca < cb
+	}
+	return len(a) < len(b)
+}
+
+// chunk returns the leading run of digits or other characters in s
+func chunk(s string) string {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// backups writes tarballs of two runs in nested directories
+func backups() {
+	fs = afero.NewMemMapFs()
+	for _, name := range []string{
+		"/backups/10_messages_100.tgz",
+		"/backups/2_messages_100.tgz",
+		"/backups/notes.txt",
+		"/backups/manifest.json",
+		"/backups/2024-01/day1/1_messages_5.tar.zst",
+		"/backups/2024-01/day1/.rabbitio-3f0e.tmp",
+		"/backups/2024-02/day1/1_messages_7.tgz",
+		"/backups/2023-12/1_messages_9.tgz",
+	} {
+		afero.WriteFile(fs, name, []byte("mymessage"), 0644)
+	}
+}
+
+func TestNewInputs(t *testing.T) {
+	backups()
+
+	p, err := NewInputs([]string{"/backups"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/backups/2_messages_100.tgz", "/backups/10_messages_100.tgz"}, p.queue,
+		"should skip directories and files that are not tarballs, in natural order")
+
+	p, err = NewInputs([]string{"/backups"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/backups/2_messages_100.tgz",
+		"/backups/10_messages_100.tgz",
+		"/backups/2023-12/1_messages_9.tgz",
+		"/backups/2024-01/day1/1_messages_5.tar.zst",
+		"/backups/2024-02/day1/1_messages_7.tgz",
+	}, p.queue)
+}
+
+func TestNewInputs_Glob(t *testing.T) {
+	backups()
+
+	p, err := NewInputs([]string{"/backups/2024-*/**/*.tgz"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/backups/2024-02/day1/1_messages_7.tgz"}, p.queue)
+
+	p, err = NewInputs([]string{"/backups/2024-*", "/backups/2023-12", "/backups/2024-02/day1/1_messages_7.tgz"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/backups/2024-01/day1/1_messages_5.tar.zst",
+		"/backups/2024-02/day1/1_messages_7.tgz",
+		"/backups/2023-12/1_messages_9.tgz",
+	}, p.queue, "should keep the order of the paths and queue every file once")
+
+	_, err = NewInputs([]string{"/backups/2025-*/*.tgz"}, false)
+	assert.Error(t, err, "should return an error when nothing matches")
+	_, err = NewInputs([]string{"/backups/[*.tgz"}, false)
+	assert.Error(t, err, "should return an error on an invalid pattern")
+}
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"2_messages_100.tgz", "10_messages_100.tgz", true},
+		{"10_messages_100.tgz", "2_messages_100.tgz", false},
+		{"1_messages_100.tgz", "1_messages_20.tgz", false},
+		{"run-a_9_messages_1.tgz", "run-b_1_messages_1.tgz", true},
+		{"007.tgz", "7.tgz", true},
+		{"1.tgz", "1.tgz", false},
+		{"dir/1", "dir/1/2", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.less, naturalLess(tt.a, tt.b), "%s < %s", tt.a, tt.b)
+	}
+}
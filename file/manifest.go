@@ -0,0 +1,388 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/afero"
+)
+
+// ManifestName is the file name of the manifest in the output directory
+const ManifestName = "manifest.json"
+
+// manifestLock is created exclusively while a run saves the manifest, as
+// several runs may write into the same directory
+const manifestLock = tempPrefix + ManifestName + ".lock" + tempSuffix
+
+var (
+	// lockRetry is the wait before trying again to lock the manifest
+	lockRetry = 10 * time.Millisecond
+	// lockTimeout is how long a run waits for the manifest lock
+	lockTimeout = 30 * time.Second
+)
+
+// ErrVerify is returned when a directory does not match its manifest
+var ErrVerify = errors.New("verification failed")
+
+// Manifest records the source of the latest backup run into a directory, every
+// run and the tarballs of all runs
+type Manifest struct {
+	lock       sync.Mutex
+	Version    string         `json:"rabbitio_version"`
+	URI        string         `json:"uri"`
+	VHost      string         `json:"vhost"`
+	Exchange   string         `json:"exchange"`
+	Queue      string         `json:"queue"`
+	RoutingKey string         `json:"routing_key"`
+	Started    time.Time      `json:"started"`
+	Finished   *time.Time     `json:"finished,omitempty"`
+	Runs       []ManifestRun  `json:"runs"`
+	Files      []ManifestFile `json:"files"`
+	// Topology, Recipients, Redactions and RedactionKey of the current run
+	// are only recorded in its ManifestRun
+	Topology     *rmq.Topology `json:"-"`
+	Recipients   []string      `json:"-"`
+	Redactions   []string      `json:"-"`
+	RedactionKey string        `json:"-"`
+	// run is the ID of the current run
+	run string
+}
+
+// ManifestRun is a backup run into the directory, its source, the topology
+// declared, the recipients its tarballs are encrypted to and the redaction
+// rules and key ID its messages are redacted with
+type ManifestRun struct {
+	ID           string        `json:"id"`
+	URI          string        `json:"uri"`
+	VHost        string        `json:"vhost"`
+	Exchange     string        `json:"exchange"`
+	Queue        string        `json:"queue"`
+	RoutingKey   string        `json:"routing_key"`
+	Topology     *rmq.Topology `json:"topology,omitempty"`
+	Started      time.Time     `json:"started"`
+	Finished     *time.Time    `json:"finished,omitempty"`
+	Recipients   []string      `json:"recipients,omitempty"`
+	Redactions   []string      `json:"redactions,omitempty"`
+	RedactionKey string        `json:"redaction_key,omitempty"`
+}
+
+// legacyManifest has the fields recorded at the top of manifests written
+// before they were recorded for every run
+type legacyManifest struct {
+	Topology     *rmq.Topology `json:"topology"`
+	Recipients   []string      `json:"recipients"`
+	Redactions   []string      `json:"redactions"`
+	RedactionKey string        `json:"redaction_key"`
+}
+
+// ManifestFile is a tarball written in a backup run
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Run      string `json:"run,omitempty"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+}
+
+// source returns the run of the source recorded at the top of the manifest
+func (m *Manifest) source(id string) ManifestRun {
+	return ManifestRun{
+		ID:           id,
+		URI:          m.URI,
+		VHost:        m.VHost,
+		Exchange:     m.Exchange,
+		Queue:        m.Queue,
+		RoutingKey:   m.RoutingKey,
+		Topology:     m.Topology,
+		Started:      m.Started,
+		Finished:     m.Finished,
+		Recipients:   m.Recipients,
+		Redactions:   m.Redactions,
+		RedactionKey: m.RedactionKey,
+	}
+}
+
+// Run returns the run with the id, or nil when it is not recorded
+func (m *Manifest) Run(id string) *ManifestRun {
+	for i := range m.Runs {
+		if m.Runs[i].ID == id {
+			return &m.Runs[i]
+		}
+	}
+	return nil
+}
+
+// add a written tarball and save the manifest in dir
+func (m *Manifest) add(dir string, f ManifestFile) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f.Run = m.run
+	for i := range m.Files {
+		if m.Files[i].Name == f.Name {
+			m.Files = append(m.Files[:i], m.Files[i+1:]...)
+			break
+		}
+	}
+	m.Files = append(m.Files, f)
+	return m.save(dir)
+}
+
+// keep the runs and tarballs of earlier runs listed in the manifest of dir,
+// and start the run with the id, a new one when empty
+func (m *Manifest) keep(dir, id string) error {
+	earlier, err := ReadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if id == "" {
+		id = NewRunID()
+	}
+	m.run = id
+	if earlier != nil {
+		m.Runs = append(earlier.Runs, m.Runs...)
+		m.Files = append(earlier.Files, m.Files...)
+	}
+	m.Runs = append(m.Runs, m.source(id))
+	return nil
+}
+
+// finish records the end of the backup run and saves the manifest in dir
+func (m *Manifest) finish(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().UTC()
+	m.Finished = &now
+	for i := range m.Runs {
+		if m.Runs[i].ID == m.run {
+			m.Runs[i].Finished = &now
+		}
+	}
+	return m.save(dir)
+}
+
+// save writes the manifest to a temporary file renamed to the manifest. It
+// holds the manifest lock meanwhile and first adds what other runs into the
+// directory saved since the manifest was read
+func (m *Manifest) save(dir string) error {
+	unlock, err := lockManifest(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	saved, err := ReadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if saved != nil {
+		m.merge(saved)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, tempPrefix+ManifestName+tempSuffix)
+	if err := afero.WriteFile(fs, tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+// merge takes the runs and tarballs of the saved manifest, which other runs
+// may have updated, and adds those of this run and those not saved yet
+func (m *Manifest) merge(saved *Manifest) {
+	runs := append([]ManifestRun(nil), saved.Runs...)
+	index := make(map[string]int)
+	for i, r := range runs {
+		index[r.ID] = i
+	}
+	for _, r := range m.Runs {
+		if i, ok := index[r.ID]; !ok {
+			runs = append(runs, r)
+		} else if r.ID == m.run {
+			runs[i] = r
+		}
+	}
+	m.Runs = runs
+
+	files := append([]ManifestFile(nil), saved.Files...)
+	index = make(map[string]int)
+	for i, f := range files {
+		index[f.Name] = i
+	}
+	for _, f := range m.Files {
+		if i, ok := index[f.Name]; !ok {
+			files = append(files, f)
+		} else if f.Run == m.run {
+			files[i] = f
+		}
+	}
+	m.Files = files
+}
+
+// lockManifest creates the lock of the manifest in dir, waiting while
+// another run holds it, and returns the func removing it
+func lockManifest(dir string) (func(), error) {
+	name := filepath.Join(dir, manifestLock)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		fh, err := fs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fh.Close()
+			return func() { fs.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("manifest of %s is locked by another run, remove %s if no run is writing to the directory", dir, name)
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+// ReadManifest reads the manifest of the directory
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := afero.ReadFile(fs, filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %s", dir, err)
+	}
+
+	// manifests written before runs were recorded describe a single run,
+	// with an ID every run into the directory derives the same
+	if len(m.Runs) == 0 && len(m.Files) > 0 {
+		var legacy legacyManifest
+		json.Unmarshal(b, &legacy)
+		m.Topology = legacy.Topology
+		m.Recipients = legacy.Recipients
+		m.Redactions = legacy.Redactions
+		m.RedactionKey = legacy.RedactionKey
+		run := m.source(m.Started.UTC().Format(timeFormat))
+		m.Runs = []ManifestRun{run}
+		for i := range m.Files {
+			m.Files[i].Run = run.ID
+		}
+	}
+	return m, nil
+}
+
+// Corruption is a tarball not matching the manifest
+type Corruption struct {
+	Name   string
+	Reason string
+}
+
+// Verification is the result of checking a directory against its manifest
+type Verification struct {
+	Manifest *Manifest
+	Valid    []string
+	Missing  []string
+	Extra    []string
+	Corrupt  []Corruption
+}
+
+// Err returns ErrVerify when any tarball is missing, extra or corrupt
+func (v *Verification) Err() error {
+	if len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Corrupt) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d missing, %d extra and %d corrupt tarballs", ErrVerify, len(v.Missing), len(v.Extra), len(v.Corrupt))
+}
+
+// Verify checks the tarballs in dir against the size and checksum in its manifest
+func Verify(dir string) (*Verification, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	v := &Verification{Manifest: m}
+
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		listed[f.Name] = true
+
+		size, sum, err := checksum(filepath.Join(dir, f.Name))
+		switch {
+		case os.IsNotExist(err):
+			v.Missing = append(v.Missing, f.Name)
+		case err != nil:
+			v.Corrupt = append(v.Corrupt, Corruption{f.Name, err.Error()})
+		case size != f.Bytes:
+			v.Corrupt = append(v.Corrupt, Corruption{f.Name, fmt.Sprintf("size is %d bytes, expected %d", size, f.Bytes)})
+		case sum != f.SHA256:
+			v.Corrupt = append(v.Corrupt, Corruption{f.Name, "checksum does not match"})
+		default:
+			v.Valid = append(v.Valid, f.Name)
+		}
+	}
+
+	files, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == ManifestName || listed[f.Name()] || isTemp(f.Name()) {
+			continue
+		}
+		v.Extra = append(v.Extra, f.Name())
+	}
+	sort.Strings(v.Extra)
+	return v, nil
+}
+
+// checksum returns the size and SHA-256 of the file
+func checksum(name string) (int64, string, error) {
+	fh, err := fs.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isTemp returns true for the temporary files of tarballs being written and
+// the manifest lock
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
@@ -0,0 +1,283 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meltwater/rabbitio/redact"
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/afero"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// receive writes the messages to tarballs of two messages with a manifest
+func receive(t *testing.T, dir string, messages int) {
+	p, _ := NewOutput(dir, 2)
+	p.Names = &Namer{Template: "{seq}_messages_{count}"}
+	p.Manifest = &Manifest{Queue: "myqueue", Exchange: "myexchange"}
+
+	ch := make(chan rmq.Message, messages)
+	for i := 0; i < messages; i++ {
+		ch <- rmq.Message{Body: []byte("mymessage")}
+	}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, messages)))
+}
+
+func TestPath_ReceiveManifest(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	receive(t, "/data", 3)
+
+	m, err := ReadManifest("/data")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "myqueue", m.Queue)
+	assert.NotNil(t, m.Finished, "should record the end of the run")
+	assert.Len(t, m.Runs, 1)
+	assert.Equal(t, "myqueue", m.Runs[0].Queue)
+	assert.NotNil(t, m.Runs[0].Finished)
+	assert.Len(t, m.Files, 2)
+	assert.Equal(t, m.Runs[0].ID, m.Files[0].Run, "should reference the run of the tarball")
+	assert.Equal(t, "1_messages_2.tgz", m.Files[0].Name)
+	assert.Equal(t, 2, m.Files[0].Messages)
+	assert.Len(t, m.Files[0].SHA256, 64)
+
+	size, sum, _ := checksum("/data/1_messages_2.tgz")
+	assert.Equal(t, size, m.Files[0].Bytes)
+	assert.Equal(t, sum, m.Files[0].SHA256)
+}
+
+func TestPath_ReceiveManifestEarlierRuns(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	p, _ := NewOutput("/data", 2)
+	afero.WriteFile(fs, "/data/earlier_1_messages_2.tgz", []byte("earlier"), 0644)
+	(&Manifest{Files: []ManifestFile{{Name: "earlier_1_messages_2.tgz"}}}).save("/data")
+
+	p.Manifest = &Manifest{Queue: "myqueue"}
+	ch := make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte("mymessage")}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 1)))
+
+	m, _ := ReadManifest("/data")
+	assert.Len(t, m.Files, 2, "should keep the tarballs of earlier runs")
+	assert.Equal(t, "earlier_1_messages_2.tgz", m.Files[0].Name)
+	assert.Equal(t, p.Names.Run+"_1_messages_1.tgz", m.Files[1].Name)
+	assert.Len(t, m.Runs, 2, "should record the earlier run of a manifest without runs")
+	assert.Equal(t, m.Runs[0].ID, m.Files[0].Run)
+	assert.Equal(t, p.Names.Run, m.Runs[1].ID)
+	assert.Equal(t, p.Names.Run, m.Files[1].Run)
+}
+
+func TestPath_ReceiveManifestRuns(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	receive(t, "/data", 2)
+	first, _ := ReadManifest("/data")
+
+	p, _ := NewOutput("/data", 2)
+	p.Manifest = &Manifest{Queue: "otherqueue", RoutingKey: "other.#", Started: time.Now().UTC()}
+	ch := make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte("mymessage")}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 1)))
+
+	m, _ := ReadManifest("/data")
+	assert.Equal(t, "otherqueue", m.Queue, "should describe the latest run at the top")
+	assert.Len(t, m.Runs, 2)
+	assert.Equal(t, first.Runs[0], m.Runs[0], "should keep the earlier run")
+	assert.Equal(t, "myqueue", m.Runs[0].Queue)
+	assert.Equal(t, "otherqueue", m.Runs[1].Queue)
+	assert.Equal(t, "other.#", m.Runs[1].RoutingKey)
+	assert.NotNil(t, m.Runs[1].Finished)
+	assert.Equal(t, m.Runs[0].ID, m.Files[0].Run)
+	assert.Equal(t, m.Runs[1].ID, m.Files[1].Run)
+}
+
+func TestPath_ReceiveManifestConcurrentRuns(t *testing.T) {
+	// the manifest lock is created exclusively, which needs a real file system
+	fs = afero.NewOsFs()
+	defer func() { fs = afero.NewMemMapFs() }()
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, _ := NewOutput(dir, 2)
+			p.Names = &Namer{Template: "{run}_{seq}_messages_{count}", Run: NewRunID()}
+			p.Manifest = &Manifest{Queue: "myqueue"}
+			ch := make(chan rmq.Message, 3)
+			for j := 0; j < 3; j++ {
+				ch <- rmq.Message{Body: []byte("mymessage")}
+			}
+			close(ch)
+			assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 3)))
+		}()
+	}
+	wg.Wait()
+
+	m, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Len(t, m.Runs, 4, "should keep the runs saved concurrently")
+	assert.Len(t, m.Files, 8, "should keep the tarballs saved concurrently")
+	runs := make(map[string]bool)
+	for _, r := range m.Runs {
+		assert.NotNil(t, r.Finished)
+		runs[r.ID] = true
+	}
+	for _, f := range m.Files {
+		assert.True(t, runs[f.Run], "should reference a recorded run")
+	}
+	v, err := Verify(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Err())
+	locked, _ := afero.Exists(fs, filepath.Join(dir, manifestLock))
+	assert.False(t, locked, "should leave no lock behind")
+}
+
+func TestLockManifest(t *testing.T) {
+	fs = afero.NewOsFs()
+	defer func() { fs = afero.NewMemMapFs() }()
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 50 * time.Millisecond
+	dir := t.TempDir()
+
+	unlock, err := lockManifest(dir)
+	assert.NoError(t, err)
+	_, err = lockManifest(dir)
+	assert.Error(t, err, "should give up while another run holds the lock")
+	unlock()
+	unlock, err = lockManifest(dir)
+	assert.NoError(t, err, "should lock again once released")
+	unlock()
+}
+
+func TestVerify(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	receive(t, "/data", 5)
+
+	v, err := Verify("/data")
+	assert.NoError(t, err)
+	assert.NoError(t, v.Err(), "should verify the written tarballs")
+	assert.Len(t, v.Valid, 3)
+
+	fs.Remove("/data/1_messages_2.tgz")
+	afero.WriteFile(fs, "/data/2_messages_2.tgz", []byte("truncated"), 0644)
+	afero.WriteFile(fs, "/data/4_messages_1.tgz", []byte("extra"), 0644)
+
+	v, err = Verify("/data")
+
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(v.Err(), ErrVerify))
+	assert.Equal(t, []string{"1_messages_2.tgz"}, v.Missing)
+	assert.Equal(t, []string{"4_messages_1.tgz"}, v.Extra)
+	assert.Len(t, v.Corrupt, 1)
+	assert.Equal(t, "2_messages_2.tgz", v.Corrupt[0].Name)
+	assert.Equal(t, []string{"3_messages_1.tgz"}, v.Valid)
+}
+
+func TestVerify_NoManifest(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	_, err := Verify("/data")
+
+	assert.Error(t, err, "should not verify a directory without manifest")
+}
+
+func TestPath_ReceiveRedacted(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	p, _ := NewOutput("/data", 10)
+	p.Names = &Namer{Template: "{seq}_messages_{count}"}
+	p.Manifest = &Manifest{}
+	p.Redactor, _ = redact.Parse([]string{"mask json $.email", "drop header token", "hash header user"}, []byte("0123456789abcdef"))
+
+	ch := make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte(`{"email":"ann@example.com"}`), Headers: amqp.Table{"token": "secret"}}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 1)))
+
+	fh, _ := fs.Open("/data/1_messages_1.tgz")
+	messages := make(chan rmq.Message, 1)
+	UnPack(new(sync.WaitGroup), fh, messages, nil)
+	m := <-messages
+	assert.Equal(t, `{"email":"***"}`, string(m.Body))
+	assert.NotContains(t, m.Headers, "token")
+	assert.Equal(t, []string{"mask json $.email", "drop header token"}, m.Redacted, "should record the rules in the tarball")
+
+	p, _ = NewOutput("/data", 10)
+	p.Names = &Namer{Template: "unredacted_{seq}_messages_{count}"}
+	p.Manifest = &Manifest{}
+	ch = make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte(`{"email":"ann@example.com"}`)}
+	close(ch)
+	assert.NoError(t, p.Receive(ch, make(chan rmq.Verify, 1)))
+
+	manifest, _ := ReadManifest("/data")
+	assert.Len(t, manifest.Runs, 2)
+	assert.Equal(t, []string{"mask json $.email", "drop header token", "hash header user"}, manifest.Runs[0].Redactions)
+	assert.Equal(t, "9f9f5111f7b27a78", manifest.Runs[0].RedactionKey, "should record the key ID, not the key")
+	assert.Empty(t, manifest.Runs[1].Redactions, "should record the redactions of every run")
+	assert.Empty(t, manifest.Runs[1].RedactionKey)
+}
+
+func TestReadManifest_Topology(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+	topology := &rmq.Topology{ExchangeType: "direct", Durable: true, QueueArgs: amqp.Table{"x-queue-type": "quorum"}, Bindings: []string{"orders"}}
+	m := &Manifest{Exchange: "myexchange", Topology: topology}
+	m.keep("/data", "myrun")
+	m.save("/data")
+
+	m, err := ReadManifest("/data")
+
+	assert.NoError(t, err)
+	assert.Equal(t, topology, m.Run("myrun").Topology, "should record the topology to declare on restore")
+	assert.Nil(t, m.Run("otherrun"))
+}
+
+func TestReadManifest_Legacy(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+	afero.WriteFile(fs, "/data/"+ManifestName, []byte(`{
+		"queue": "myqueue",
+		"started": "2018-03-15T15:40:00Z",
+		"topology": {"exchange_type": "topic", "durable": true},
+		"recipients": ["age1recipient"],
+		"redactions": ["drop header token"],
+		"redaction_key": "9f9f5111f7b27a78",
+		"files": [{"name": "1_messages_2.tgz", "messages": 2}]
+	}`), 0644)
+
+	m, err := ReadManifest("/data")
+
+	assert.NoError(t, err)
+	assert.Len(t, m.Runs, 1, "should record the run of a manifest without runs")
+	run := m.Runs[0]
+	assert.Equal(t, "20180315T154000Z", run.ID)
+	assert.Equal(t, "myqueue", run.Queue)
+	assert.Equal(t, &rmq.Topology{ExchangeType: "topic", Durable: true}, run.Topology)
+	assert.Equal(t, []string{"age1recipient"}, run.Recipients)
+	assert.Equal(t, []string{"drop header token"}, run.Redactions)
+	assert.Equal(t, "9f9f5111f7b27a78", run.RedactionKey)
+	assert.Equal(t, run.ID, m.Files[0].Run)
+}
@@ -0,0 +1,79 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// DefaultNameTemplate names the tarballs by a run-unique prefix, a sequence
+// number and the message count
+const DefaultNameTemplate = "{run}_{seq}_messages_{count}"
+
+// timeFormat is the format of timestamps in names
+const timeFormat = "20060102T150405Z"
+
+// placeholders are replaced in name templates
+var placeholders = regexp.MustCompile(`\{[^}]*\}`)
+
+// Namer names the tarballs of a run from a template with the placeholders
+// {queue}, {time}, {run}, {seq} and {count}. The file extension of the
+// compression is added to the name
+type Namer struct {
+	Template string
+	Queue    string
+	Run      string
+}
+
+// NewNamer creates a Namer for a run with a new run id
+func NewNamer(template, queue string) (*Namer, error) {
+	for _, p := range placeholders.FindAllString(template, -1) {
+		switch p {
+		case "{queue}", "{time}", "{run}", "{seq}", "{count}":
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s in name template, expected {queue}, {time}, {run}, {seq} or {count}", p)
+		}
+	}
+	if !strings.Contains(template, "{seq}") {
+		return nil, fmt.Errorf("name template %q needs {seq} to name every tarball of a run differently", template)
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return nil, fmt.Errorf("name template %q can not contain directories", template)
+	}
+	return &Namer{Template: template, Queue: queue, Run: NewRunID()}, nil
+}
+
+// NewRunID returns an id unique for every run, starting with the time
+func NewRunID() string {
+	return time.Now().UTC().Format(timeFormat) + "-" + uuid.New()[:8]
+}
+
+// name returns the name of the seq:th tarball of the run with count messages
+func (n *Namer) name(seq, count int, now time.Time, ext string) string {
+	r := strings.NewReplacer(
+		"{queue}", strings.NewReplacer("/", "_", `\`, "_").Replace(n.Queue),
+		"{time}", now.UTC().Format(timeFormat),
+		"{run}", n.Run,
+		"{seq}", strconv.Itoa(seq),
+		"{count}", strconv.Itoa(count),
+	)
+	return r.Replace(n.Template) + ext
+}
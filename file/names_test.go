@@ -0,0 +1,77 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNamer(t *testing.T) {
+	n, err := NewNamer("{queue}_{time}_{run}_{seq}_{count}", "my/queue")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, n.Run)
+
+	n.Run = "myrun"
+	now := time.Date(2018, 3, 15, 15, 37, 45, 0, time.UTC)
+	assert.Equal(t, "my_queue_20180315T153745Z_myrun_3_100.tgz", n.name(3, 100, now, ".tgz"))
+
+	for _, template := range []string{"{run}_{count}", "{seq}_{date}", "dir/{seq}", ""} {
+		_, err := NewNamer(template, "myqueue")
+		assert.Error(t, err, template)
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	assert.NotEqual(t, NewRunID(), NewRunID(), "should be unique for every run")
+}
+
+func TestPath_ReceiveOverwrite(t *testing.T) {
+	// exclusive creation needs a real file system
+	fs = afero.NewOsFs()
+	defer func() { fs = afero.NewMemMapFs() }()
+	dir := t.TempDir()
+	p, _ := NewOutput(dir, 1)
+	p.Names = &Namer{Template: "{seq}_messages_{count}"}
+	p.Manifest = &Manifest{Queue: "myqueue"}
+	afero.WriteFile(fs, dir+"/1_messages_1.tgz", []byte("earlier"), 0644)
+
+	ch := make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte("mymessage")}
+	close(ch)
+	err := p.Receive(ch, make(chan rmq.Verify, 1))
+	earlier, _ := afero.ReadFile(fs, dir+"/1_messages_1.tgz")
+	written, _ := afero.Exists(fs, dir+"/1_messages_1_2.tgz")
+	m, _ := ReadManifest(dir)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "earlier", string(earlier), "should not overwrite an existing tarball")
+	assert.True(t, written, "should add a number to the name")
+	assert.Equal(t, "1_messages_1_2.tgz", m.Files[0].Name, "should list the name written to")
+
+	p.Overwrite = true
+	ch = make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte("mymessage")}
+	close(ch)
+	err = p.Receive(ch, make(chan rmq.Verify, 1))
+	replaced, _ := afero.ReadFile(fs, dir+"/1_messages_1.tgz")
+
+	assert.NoError(t, err)
+	assert.NotEqual(t, "earlier", string(replaced))
+}
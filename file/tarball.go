@@ -16,14 +16,21 @@ package file
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
-	"compress/gzip"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"filippo.io/age"
+	"github.com/meltwater/rabbitio/filter"
+	"github.com/meltwater/rabbitio/redact"
 	"github.com/meltwater/rabbitio/rmq"
 	"github.com/pborman/uuid"
 	"github.com/spf13/afero"
@@ -32,33 +39,104 @@ import (
 // TarballBuilder build tarballs from the stream of incoming docs
 // and spits out tarballs into a channel
 type TarballBuilder struct {
-	lock    sync.Mutex
-	tarSize int
-	wg      sync.WaitGroup
-	buf     *bytes.Buffer
-	gzip    *gzip.Writer
-	tar     *tar.Writer
+	lock        sync.Mutex
+	tarSize     int
+	maxBytes    int64
+	maxAge      time.Duration
+	ackEach     bool
+	tags        []uint64
+	wg          sync.WaitGroup
+	compression Compression
+	// file is the temporary file the batch is written to, renamed to the
+	// tarball when the batch is complete
+	file afero.File
+	hash hash.Hash
+	zw   compressor
+	tar  *tar.Writer
+	// manifest records the written tarballs, when set
+	manifest *Manifest
+	// redactor redacts the messages before they are written, when set
+	redactor *redact.Redactor
+	// recipients encrypt the tarballs, when set
+	recipients []age.Recipient
+	enc        io.WriteCloser
+	// names names the tarballs, which replace existing files only with overwrite
+	names     *Namer
+	overwrite bool
+	// stream is the continuous compressed stream of a stream builder, the
+	// tar entries are written straight to it and flushed after every batch
+	stream compressor
 }
 
 // NewTarballBuilder created a TarballBuilder
-func NewTarballBuilder(tarSize int) (*TarballBuilder, error) {
+func NewTarballBuilder(tarSize int, c Compression) (*TarballBuilder, error) {
 	t := &TarballBuilder{
-		tarSize: tarSize,
+		tarSize:     tarSize,
+		compression: c,
+		names:       &Namer{Template: "{seq}_messages_{count}"},
 	}
-	err := t.getWriters()
-	return t, err
+	return t, nil
 }
 
-// get a new set of writers to write to
-func (t *TarballBuilder) getWriters() (err error) {
+// NewStreamBuilder creates a TarballBuilder writing one continuous compressed
+// tar stream to w, flushed after every batch of tarSize messages
+func NewStreamBuilder(tarSize int, c Compression, w io.Writer) (*TarballBuilder, error) {
+	stream, err := c.writer(w)
+	if err != nil {
+		return nil, err
+	}
+	t := &TarballBuilder{
+		tarSize:     tarSize,
+		compression: c,
+		stream:      stream,
+	}
+	return t, nil
+}
+
+// get a new set of writers to write the next batch to, a temporary file in
+// dir or the stream
+func (t *TarballBuilder) getWriters(dir string) (err error) {
 	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	t.buf = new(bytes.Buffer)
-	t.gzip, err = gzip.NewWriterLevel(t.buf, gzip.BestCompression)
-	t.tar = tar.NewWriter(t.gzip)
+	if t.stream != nil {
+		t.tar = tar.NewWriter(t.stream)
+		return nil
+	}
 
-	t.lock.Unlock()
-	return err
+	t.file, err = fs.OpenFile(filepath.Join(dir, tempPrefix+uuid.New()+tempSuffix), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	t.hash = sha256.New()
+	w := io.MultiWriter(t.file, t.hash)
+	if len(t.recipients) > 0 {
+		if t.enc, err = age.Encrypt(w, t.recipients...); err != nil {
+			t.discard()
+			return err
+		}
+		w = t.enc
+	}
+	if t.zw, err = t.compression.writer(w); err != nil {
+		t.discard()
+		return err
+	}
+	t.tar = tar.NewWriter(t.zw)
+	return nil
+}
+
+// discard the batch being written, removing its temporary file
+func (t *TarballBuilder) discard() {
+	t.tar = nil
+	t.enc = nil
+	if t.file == nil {
+		return
+	}
+	t.file.Close()
+	if err := fs.Remove(t.file.Name()); err != nil {
+		log.Printf("Failed to remove %s: %s", t.file.Name(), err)
+	}
+	t.file = nil
 }
 
 // add a new file to the tarball writer
@@ -67,7 +145,10 @@ func (t *TarballBuilder) addFile(tw *tar.Writer, name string, m *rmq.Message) er
 	header.Name = name
 	header.Size = int64(len(m.Body))
 	header.Mode = 0644
-	header.ModTime = time.Now()
+	header.ModTime = m.Received
+	if header.ModTime.IsZero() {
+		header.ModTime = time.Now()
+	}
 	header.Format = tar.FormatPAX
 	header.Xattrs = m.ToPAXRecords()
 	header.Xattrs["RABBITIO.amqp.routingkey"] = m.RoutingKey
@@ -81,107 +162,261 @@ func (t *TarballBuilder) addFile(tw *tar.Writer, name string, m *rmq.Message) er
 	return nil
 }
 
-// UnPack will decompress and send messages out on channel from file
-func UnPack(wg *sync.WaitGroup, file afero.File, messages chan rmq.Message) (n int, err error) {
+// UnPack will decompress and send messages out on channel from file, messages
+// not matching the filter are skipped. The compression is detected from the
+// magic bytes, and the file may hold several tarballs after each other, like
+// a stream of concatenated tarballs
+func UnPack(wg *sync.WaitGroup, file afero.File, messages chan rmq.Message, f *filter.Filter) (n, skipped int, err error) {
+	return unpack(wg, file.Name(), file, messages, f)
+}
+
+// unpack the messages of the tarballs in the file name read from file
+func unpack(wg *sync.WaitGroup, name string, file io.Reader, messages chan rmq.Message, f *filter.Filter) (n, skipped int, err error) {
 
-	// wrap fh in a gzip reader
-	gr, err := gzip.NewReader(file)
+	// wrap fh in a decompressing reader
+	zr, err := decompress(bufio.NewReader(file))
 	if err != nil {
-		return n, err
+		return n, skipped, err
 	}
+	defer zr.Close()
+	r := bufio.NewReader(zr)
 
-	// adds tar reader in the gzip
-	tr := tar.NewReader(gr)
-
-	// loop over the files in the tarball
+	// read tarballs until the end of the file
 	for {
-		hdr, terr := tr.Next()
-		if terr == io.EOF {
-			// end of tar archive
-			break
+		if _, err := r.Peek(1); err == io.EOF {
+			return n, skipped, nil
+		} else if err != nil {
+			return n, skipped, err
 		}
-		if terr != nil {
-			return n, terr
-		}
-		wg.Add(1)
 
-		// create a Buffer to work on
-		// TODO: reuse if GC pressure is a problem
-		buf := bytes.NewBuffer(make([]byte, 0, hdr.Size))
+		// adds tar reader in the decompressed stream
+		tr := tar.NewReader(r)
 
-		// copy the doc from the tarball to our buffer
-		if _, err = io.Copy(buf, tr); err != nil {
-			return n, err
-		}
+		// loop over the files in the tarball
+		for {
+			hdr, terr := tr.Next()
+			if terr == io.EOF {
+				// end of tar archive
+				break
+			}
+			if terr != nil {
+				return n, skipped, terr
+			}
+
+			// create a Buffer to work on
+			// TODO: reuse if GC pressure is a problem
+			buf := bytes.NewBuffer(make([]byte, 0, hdr.Size))
+
+			// copy the doc from the tarball to our buffer
+			if _, err = io.Copy(buf, tr); err != nil {
+				return n, skipped, err
+			}
+
+			// generate and push the message to the output channel
+			m := rmq.NewMessage(buf.Bytes(), hdr.Xattrs)
+			if !f.Match(m) {
+				skipped++
+				continue
+			}
+			m.Tarball = name
+			m.Entry = hdr.Name
+			m.Received = hdr.ModTime
 
-		// generate and push the message to the output channel
-		messages <- *rmq.NewMessage(buf.Bytes(), hdr.Xattrs)
-		n++
+			wg.Add(1)
+			messages <- *m
+			n++
+		}
 	}
-	return n, err
 }
 
-// Pack messages from the channel into the directory
+// Pack messages from the channel into the directory. Every batch is streamed
+// to a temporary file, renamed to the tarball once complete and only then acked.
+// A batch is complete with tarSize messages, maxBytes of message bodies or when
+// its first message is maxAge old
 func (t *TarballBuilder) Pack(messages chan rmq.Message, dir string, verify chan rmq.Verify) error {
 
 	t.wg.Add(1)
+	defer close(verify)
+	defer t.discard()
 
 	docNum := 0
 	fileNum := 0
+	var size int64
 
-	var deliveryTag uint64
-	for doc := range messages {
-		deliveryTag = doc.DeliveryTag
-
-		docNum++
-		if docNum >= t.tarSize {
+	// age is nil, and never fires, until the first message of a batch
+	var age <-chan time.Time
+	var timer *time.Timer
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		age = nil
+	}
+	defer stopTimer()
 
-			fileNum++
-			t.tar.Flush()
-			t.tar.Close()
-			t.gzip.Close()
+	var channel uint64
+	rotate := func() error {
+		fileNum++
+		if err := t.write(dir, fileNum, docNum); err != nil {
+			return err
+		}
+		t.ack(verify, channel)
+		docNum = 0
+		size = 0
+		stopTimer()
+		return nil
+	}
 
-			// writes to tarball here when reached the t.tarSize
-			err := writeFile(t.buf.Bytes(), dir, fmt.Sprintf("%d_messages_%d.tgz", fileNum, docNum))
-			if err != nil {
+	for {
+		var doc rmq.Message
+		var ok bool
+		select {
+		case doc, ok = <-messages:
+		case <-age:
+			log.Printf("Batch is %s old, rotating", t.maxAge)
+			if err := rotate(); err != nil {
 				return err
 			}
-			verify <- rmq.Verify{MultiAck: true, Tag: doc.DeliveryTag}
+			continue
+		}
+		if !ok {
+			break
+		}
 
-			err = t.getWriters()
-			if err != nil {
-				return err
+		// unacked messages of a closed channel are redelivered by RabbitMQ
+		if docNum > 0 && doc.Channel != channel {
+			if t.stream != nil {
+				log.Printf("Streamed %d messages delivered on a closed channel, they are streamed again when redelivered", docNum)
+			} else {
+				log.Printf("Discarding %d messages delivered on a closed channel", docNum)
 			}
+			t.discard()
+			t.tags = nil
 			docNum = 0
+			size = 0
+			stopTimer()
 		}
+		channel = doc.Channel
 
+		if t.tar == nil {
+			if err := t.getWriters(dir); err != nil {
+				return err
+			}
+		}
+		t.redactor.Redact(&doc)
 		if err := t.addFile(t.tar, uuid.New()+".rio", &doc); err != nil {
 			return err
 		}
-	}
-	t.tar.Flush()
-	t.tar.Close()
-	t.gzip.Close()
+		t.tags = append(t.tags, doc.DeliveryTag)
 
-	fileNum++
+		docNum++
+		size += int64(len(doc.Body))
+		if docNum == 1 && t.maxAge > 0 {
+			timer = time.NewTimer(t.maxAge)
+			age = timer.C
+		}
+		if docNum >= t.tarSize || (t.maxBytes > 0 && size >= t.maxBytes) {
+			if err := rotate(); err != nil {
+				return err
+			}
+		}
+	}
 
 	// writes to tarball here when not reached the t.tarSize
-	err := writeFile(t.buf.Bytes(), dir, fmt.Sprintf("%d_messages_%d.tgz", fileNum, docNum))
-	if err != nil {
-		return err
+	if docNum > 0 {
+		if err := rotate(); err != nil {
+			return err
+		}
+	}
+	if t.stream != nil {
+		// end the tar archive and the compressed stream
+		if err := tar.NewWriter(t.stream).Close(); err != nil {
+			return err
+		}
+		if err := t.stream.Close(); err != nil {
+			return err
+		}
 	}
-
-	// Does not ack the messages unless it is repeated, not sure why yet..
-	// Might want to change using delivery ack interface
-	verify <- rmq.Verify{MultiAck: true, Tag: deliveryTag}
-	verify <- rmq.Verify{MultiAck: true, Tag: deliveryTag}
 
 	t.wg.Done()
-	close(verify)
 	log.Print("tarball writer closing")
 	return nil
 }
 
+// write the batch of messages to the stream, or complete the temporary file
+// and rename it to the tarball in dir
+func (t *TarballBuilder) write(dir string, fileNum, docNum int) error {
+	if t.stream != nil {
+		// the stream continues, without an end of archive after the batch
+		if err := t.tar.Flush(); err != nil {
+			return err
+		}
+		t.tar = nil
+		if err := t.stream.Flush(); err != nil {
+			return err
+		}
+		log.Printf("Streamed batch %d of %d messages", fileNum, docNum)
+		return nil
+	}
+
+	if err := t.tar.Close(); err != nil {
+		return err
+	}
+	t.tar = nil
+	if err := t.zw.Close(); err != nil {
+		return err
+	}
+	if t.enc != nil {
+		if err := t.enc.Close(); err != nil {
+			return err
+		}
+		t.enc = nil
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	tmp := t.file.Name()
+	t.file = nil
+
+	ext := t.compression.Extension()
+	if len(t.recipients) > 0 {
+		ext += ageExtension
+	}
+	base := t.names.name(fileNum, docNum, time.Now(), "")
+	name, size, err := renameFile(tmp, dir, base, ext, t.overwrite)
+	if err != nil {
+		return err
+	}
+	if t.manifest != nil {
+		return t.manifest.add(dir, ManifestFile{
+			Name:     name,
+			Messages: docNum,
+			Bytes:    size,
+			SHA256:   hex.EncodeToString(t.hash.Sum(nil)),
+		})
+	}
+	return nil
+}
+
+// ack the messages of the written tarball, with a single multiple ack unless
+// other messages on the channel are not written by this TarballBuilder
+func (t *TarballBuilder) ack(verify chan rmq.Verify, channel uint64) {
+	if len(t.tags) == 0 {
+		return
+	}
+	if t.ackEach {
+		for _, tag := range t.tags {
+			verify <- rmq.Verify{Tag: tag, Channel: channel}
+		}
+	} else {
+		verify <- rmq.Verify{MultiAck: true, Tag: t.tags[len(t.tags)-1], Channel: channel}
+	}
+	t.tags = nil
+}
+
 // CloseWaiter waits for the wg and then closes
 func (t *TarballBuilder) CloseWaiter(out chan []byte) {
 	t.wg.Wait()
@@ -15,7 +15,10 @@
 package file
 
 import (
+	"bytes"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/meltwater/rabbitio/rmq"
 	"github.com/spf13/afero"
@@ -23,19 +26,31 @@ import (
 )
 
 func TestNewTarballBuilder(t *testing.T) {
-	_, err := NewTarballBuilder(1000)
+	_, err := NewTarballBuilder(1000, DefaultCompression)
 	assert.NoError(t, err, "should not return error when creating a tarball builder")
 }
 
 func TestTarballBuilder_GetWriters(t *testing.T) {
-	tarball, _ := NewTarballBuilder(1000)
-	err := tarball.getWriters()
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(1000, DefaultCompression)
+	err := tarball.getWriters("/data")
+	files, _ := afero.ReadDir(fs, "/data")
+	tarball.discard()
+	discarded, _ := afero.ReadDir(fs, "/data")
 
 	assert.NoError(t, err)
+	assert.Len(t, files, 1, "should create a temporary file for the batch")
+	assert.Empty(t, discarded, "should remove the temporary file when discarded")
 }
 
 func TestTarballBuilder_AddFile(t *testing.T) {
-	tarball, _ := NewTarballBuilder(1000)
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(1000, DefaultCompression)
+	tarball.getWriters("/data")
 	m := &rmq.Message{Body: []byte("mymessage"), RoutingKey: "rk"}
 
 	err := tarball.addFile(tarball.tar, "file.tgz", m)
@@ -46,19 +61,254 @@ func TestTarballBuilder_AddFile(t *testing.T) {
 func TestTarballBuilder_Pack(t *testing.T) {
 	fs = afero.NewMemMapFs()
 
-	tarball, _ := NewTarballBuilder(1)
+	tarball, _ := NewTarballBuilder(1, DefaultCompression)
 	ch := make(chan rmq.Message, 1)
 	verify := make(chan rmq.Verify, 1)
 	fs.MkdirAll("/data", 0755)
 
-	var err error
-
 	ch <- rmq.Message{Body: []byte("mymessage")}
+	close(ch)
+
+	err := tarball.Pack(ch, "/data", verify)
+
+	assert.NoError(t, err, "received no error")
+}
+
+func TestTarballBuilder_PackAcksWrittenMessages(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(2, DefaultCompression)
+	ch := make(chan rmq.Message, 3)
+	verify := make(chan rmq.Verify, 3)
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		ch <- rmq.Message{Body: []byte("mymessage"), DeliveryTag: tag}
+	}
+	close(ch)
+
+	err := tarball.Pack(ch, "/data", verify)
+
+	var acks []uint64
+	for v := range verify {
+		acks = append(acks, v.Tag)
+	}
+	full, _ := afero.Exists(fs, "/data/1_messages_2.tgz")
+	last, _ := afero.Exists(fs, "/data/2_messages_1.tgz")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3}, acks, "should ack each tarball after it is written")
+	assert.True(t, full, "should write a full tarball")
+	assert.True(t, last, "should write the remaining messages")
+}
+
+func TestTarballBuilder_PackNoMessages(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(2, DefaultCompression)
+	ch := make(chan rmq.Message)
+	verify := make(chan rmq.Verify, 1)
+	close(ch)
+
+	err := tarball.Pack(ch, "/data", verify)
+
+	files, _ := afero.ReadDir(fs, "/data")
+	_, open := <-verify
+
+	assert.NoError(t, err)
+	assert.Empty(t, files, "should not write an empty tarball")
+	assert.False(t, open, "should close verify without acking")
+}
+
+func TestTarballBuilder_PackDiscardsClosedChannel(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(3, DefaultCompression)
+	ch := make(chan rmq.Message, 4)
+	verify := make(chan rmq.Verify, 2)
+
+	ch <- rmq.Message{Body: []byte("lost"), DeliveryTag: 1, Channel: 1}
+	ch <- rmq.Message{Body: []byte("lost"), DeliveryTag: 2, Channel: 1}
+	ch <- rmq.Message{Body: []byte("redelivered"), DeliveryTag: 1, Channel: 2}
+	ch <- rmq.Message{Body: []byte("redelivered"), DeliveryTag: 2, Channel: 2}
+	close(ch)
+
+	err := tarball.Pack(ch, "/data", verify)
+
+	var acks []rmq.Verify
+	for v := range verify {
+		acks = append(acks, v)
+	}
+	written, _ := afero.Exists(fs, "/data/1_messages_2.tgz")
+	files, _ := afero.ReadDir(fs, "/data")
+
+	assert.NoError(t, err)
+	assert.True(t, written, "should only write the messages of the open channel")
+	assert.Len(t, files, 1, "should remove the temporary file of the discarded messages")
+	assert.Equal(t, []rmq.Verify{{MultiAck: true, Tag: 2, Channel: 2}}, acks)
+}
+
+func TestTarballBuilder_PackStream(t *testing.T) {
+	fs = afero.NewMemMapFs()
+
+	var out bytes.Buffer
+	tarball, _ := NewStreamBuilder(2, DefaultCompression, &out)
+	ch := make(chan rmq.Message, 3)
+	verify := make(chan rmq.Verify, 3)
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		ch <- rmq.Message{Body: []byte("mymessage"), RoutingKey: "rk", DeliveryTag: tag}
+	}
+	close(ch)
+
+	err := tarball.Pack(ch, "", verify)
+
+	var acks []uint64
+	for v := range verify {
+		acks = append(acks, v.Tag)
+	}
+	files, _ := afero.ReadDir(fs, "/")
+
+	afero.WriteFile(fs, "stream.tgz", out.Bytes(), 0644)
+	fh, _ := fs.Open("stream.tgz")
+	messages := make(chan rmq.Message, 3)
+	n, _, unpackErr := UnPack(new(sync.WaitGroup), fh, messages, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3}, acks, "should ack each batch after it is streamed")
+	assert.Empty(t, files, "should not write any files")
+	assert.NoError(t, unpackErr)
+	assert.Equal(t, 3, n, "should read all batches as one tarball")
+	assert.Equal(t, "rk", (<-messages).RoutingKey)
+}
+
+// writes signals the writes to a stream
+type writes chan int
+
+func (w writes) Write(p []byte) (int, error) {
+	select {
+	case w <- len(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestTarballBuilder_PackStreamUnbuffered(t *testing.T) {
+	w := make(writes, 1)
+	tarball, _ := NewStreamBuilder(1000, Compression{Codec: None}, w)
+	ch := make(chan rmq.Message)
+	packed := make(chan error, 1)
 	go func() {
-		err = tarball.Pack(ch, "/data", verify)
+		packed <- tarball.Pack(ch, "", make(chan rmq.Verify, 1))
 	}()
 
+	ch <- rmq.Message{Body: []byte("mymessage"), DeliveryTag: 1}
+	select {
+	case <-w:
+	case <-time.After(5 * time.Second):
+		t.Fatal("should write the message before the batch is complete")
+	}
 	close(ch)
+	assert.NoError(t, <-packed)
+}
 
-	assert.NoError(t, err, "received no error")
+func TestUnPack_Concatenated(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(1, DefaultCompression)
+	ch := make(chan rmq.Message, 2)
+	ch <- rmq.Message{Body: []byte("first")}
+	ch <- rmq.Message{Body: []byte("second")}
+	close(ch)
+	tarball.Pack(ch, "/data", make(chan rmq.Verify, 2))
+
+	first, _ := afero.ReadFile(fs, "/data/1_messages_1.tgz")
+	second, _ := afero.ReadFile(fs, "/data/2_messages_1.tgz")
+	afero.WriteFile(fs, "/stream.tgz", append(first, second...), 0644)
+
+	fh, _ := fs.Open("/stream.tgz")
+	messages := make(chan rmq.Message, 2)
+	n, _, err := UnPack(new(sync.WaitGroup), fh, messages, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "should read every tarball in the stream")
+	assert.Equal(t, "first", string((<-messages).Body))
+	assert.Equal(t, "second", string((<-messages).Body))
+}
+
+func TestTarballBuilder_PackMaxBytes(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(100, DefaultCompression)
+	tarball.maxBytes = 10
+	ch := make(chan rmq.Message, 3)
+	verify := make(chan rmq.Verify, 3)
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		ch <- rmq.Message{Body: []byte("123456"), DeliveryTag: tag}
+	}
+	close(ch)
+
+	err := tarball.Pack(ch, "/data", verify)
+
+	var acks []uint64
+	for v := range verify {
+		acks = append(acks, v.Tag)
+	}
+	first, _ := afero.Exists(fs, "/data/1_messages_2.tgz")
+
+	assert.NoError(t, err)
+	assert.True(t, first, "should rotate when the bodies reach max bytes")
+	assert.Equal(t, []uint64{2, 3}, acks)
+}
+
+func TestTarballBuilder_PackMaxAge(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+
+	tarball, _ := NewTarballBuilder(100, DefaultCompression)
+	tarball.maxAge = 10 * time.Millisecond
+	ch := make(chan rmq.Message)
+	verify := make(chan rmq.Verify, 2)
+
+	done := make(chan error)
+	go func() {
+		done <- tarball.Pack(ch, "/data", verify)
+	}()
+	ch <- rmq.Message{Body: []byte("mymessage"), DeliveryTag: 1}
+
+	select {
+	case v := <-verify:
+		assert.Equal(t, uint64(1), v.Tag, "should ack the rotated tarball")
+	case <-time.After(time.Second):
+		t.Fatal("should rotate after max age without more messages")
+	}
+	written, _ := afero.Exists(fs, "/data/1_messages_1.tgz")
+
+	close(ch)
+	assert.NoError(t, <-done)
+	assert.True(t, written, "should write the tarball when the batch is max age old")
+}
+
+func TestUnPack_Received(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.MkdirAll("/data", 0755)
+	received := time.Date(2018, 3, 15, 15, 37, 45, 123456789, time.UTC)
+
+	tarball, _ := NewTarballBuilder(1, DefaultCompression)
+	ch := make(chan rmq.Message, 1)
+	ch <- rmq.Message{Body: []byte("first"), Received: received}
+	close(ch)
+	tarball.Pack(ch, "/data", make(chan rmq.Verify, 1))
+
+	fh, _ := fs.Open("/data/1_messages_1.tgz")
+	messages := make(chan rmq.Message, 1)
+	_, _, err := UnPack(new(sync.WaitGroup), fh, messages, nil)
+
+	assert.NoError(t, err)
+	assert.True(t, received.Equal((<-messages).Received), "should keep when the message was consumed")
 }
@@ -0,0 +1,411 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filter matches messages against expressions like
+//
+//	routingkey == "orders.created" and headers.retries >= 3
+//	properties.content_type == "application/json" && $.customer.country =~ "^(SE|NO)$"
+//	not headers["x-death"] or size > 1024
+//
+// Fields are routingkey, size, body, headers.<name>, properties.<name> and
+// JSONPaths into JSON bodies starting with $. Headers and JSON values can be
+// indexed with [0], ["key"] and [*], a comparison matches when any of the
+// selected values matches. Operators are ==, !=, <, <=, >, >=, =~ and !~ for
+// regular expressions, combined with and, or, not and parentheses. A field
+// without a comparison matches when it is present, or true for booleans.
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/streadway/amqp"
+)
+
+// Filter is a parsed expression matching messages
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse parses a filter expression
+func Parse(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %s", err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %s", err)
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("invalid filter: at %d: unexpected %q", t.pos, t.val)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match returns true if the message matches the filter, a nil Filter matches
+// all messages
+func (f *Filter) Match(m *rmq.Message) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.eval(&message{Message: m})
+}
+
+// String returns the expression of the filter
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// message is evaluated by the nodes, the JSON body is decoded once
+type message struct {
+	*rmq.Message
+	decoded bool
+	json    interface{}
+	isJSON  bool
+}
+
+// body returns the decoded JSON body
+func (m *message) body() (interface{}, bool) {
+	if !m.decoded {
+		m.decoded = true
+		d := json.NewDecoder(bytes.NewReader(m.Body))
+		d.UseNumber()
+		m.isJSON = d.Decode(&m.json) == nil
+	}
+	return m.json, m.isJSON
+}
+
+// node is a boolean expression
+type node interface {
+	eval(m *message) bool
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(m *message) bool { return n.left.eval(m) || n.right.eval(m) }
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(m *message) bool { return n.left.eval(m) && n.right.eval(m) }
+
+type notNode struct{ n node }
+
+func (n *notNode) eval(m *message) bool { return !n.n.eval(m) }
+
+// existsNode matches when the operand is present, booleans by their value
+type existsNode struct{ operand *operand }
+
+func (n *existsNode) eval(m *message) bool {
+	for _, v := range n.operand.values(m) {
+		if b, ok := v.(bool); !ok || b {
+			return true
+		}
+	}
+	return false
+}
+
+// compareNode compares the operand with a literal, negated operators match
+// when none of the values match the positive operator
+type compareNode struct {
+	operand *operand
+	op      string
+	literal interface{}
+	regexp  *regexp.Regexp
+}
+
+func (n *compareNode) eval(m *message) bool {
+	values := n.operand.values(m)
+
+	switch n.op {
+	case "!=":
+		return !n.any(values, "==")
+	case "!~":
+		return !n.any(values, "=~")
+	}
+	return n.any(values, n.op)
+}
+
+func (n *compareNode) any(values []interface{}, op string) bool {
+	for _, v := range values {
+		if n.compare(normalize(v), op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *compareNode) compare(v interface{}, op string) bool {
+	if op == "=~" {
+		s, ok := text(v)
+		return ok && n.regexp.MatchString(s)
+	}
+
+	switch l := n.literal.(type) {
+	case float64:
+		f, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		return order(op, compareFloat(f, l))
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		return order(op, compareString(s, l))
+	case bool:
+		b, ok := v.(bool)
+		return ok && op == "==" && b == l
+	}
+	return false
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// order returns if the result of a comparison satisfies the operator
+func order(op string, c int) bool {
+	switch op {
+	case "==":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// normalize converts numbers to float64, timestamps to unix seconds and
+// bytes to strings, so they compare with the literals
+func normalize(v interface{}) interface{} {
+	switch fv := v.(type) {
+	case int:
+		return float64(fv)
+	case int8:
+		return float64(fv)
+	case uint8:
+		return float64(fv)
+	case int16:
+		return float64(fv)
+	case int32:
+		return float64(fv)
+	case int64:
+		return float64(fv)
+	case uint64:
+		return float64(fv)
+	case float32:
+		return float64(fv)
+	case json.Number:
+		if f, err := fv.Float64(); err == nil {
+			return f
+		}
+		return fv.String()
+	case amqp.Decimal:
+		return float64(fv.Value) / math.Pow10(int(fv.Scale))
+	case time.Time:
+		return float64(fv.Unix())
+	case []byte:
+		return string(fv)
+	}
+	return v
+}
+
+// text returns the value as a string for regular expressions
+func text(v interface{}) (string, bool) {
+	switch fv := v.(type) {
+	case string:
+		return fv, true
+	case float64:
+		return strconv.FormatFloat(fv, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(fv), true
+	}
+	return "", false
+}
+
+// field of the message an operand refers to
+type field int
+
+const (
+	fieldRoutingKey field = iota
+	fieldSize
+	fieldBody
+	fieldHeaders
+	fieldProperties
+	fieldJSON
+)
+
+// selector selects a key of a table or object, or an index of an array
+type selector struct {
+	key      string
+	index    int
+	wildcard bool
+}
+
+// operand is a field of the message, with selectors into its value
+type operand struct {
+	field     field
+	name      string
+	selectors []selector
+}
+
+// values returns the selected values, none when the field is missing
+func (o *operand) values(m *message) []interface{} {
+	var v interface{}
+
+	switch o.field {
+	case fieldRoutingKey:
+		return []interface{}{m.RoutingKey}
+	case fieldSize:
+		return []interface{}{len(m.Body)}
+	case fieldBody:
+		if len(m.Body) == 0 {
+			return nil
+		}
+		return []interface{}{m.Body}
+	case fieldProperties:
+		p, ok := property(&m.Properties, o.name)
+		if !ok {
+			return nil
+		}
+		return []interface{}{p}
+	case fieldHeaders:
+		h, ok := m.Headers[o.name]
+		if !ok {
+			return nil
+		}
+		v = h
+	case fieldJSON:
+		body, ok := m.body()
+		if !ok {
+			return nil
+		}
+		v = body
+	}
+
+	values := []interface{}{v}
+	for _, s := range o.selectors {
+		var selected []interface{}
+		for _, v := range values {
+			selected = append(selected, s.apply(v)...)
+		}
+		values = selected
+	}
+	return values
+}
+
+// apply returns the values selected from a table, object or array
+func (s selector) apply(v interface{}) []interface{} {
+	switch fv := v.(type) {
+	case amqp.Table:
+		return s.applyMap(fv)
+	case map[string]interface{}:
+		return s.applyMap(fv)
+	case []interface{}:
+		if s.wildcard {
+			return fv
+		}
+		if s.index >= 0 && s.index < len(fv) {
+			return []interface{}{fv[s.index]}
+		}
+	}
+	return nil
+}
+
+func (s selector) applyMap(m map[string]interface{}) []interface{} {
+	if s.wildcard {
+		var values []interface{}
+		for _, v := range m {
+			values = append(values, v)
+		}
+		return values
+	}
+	if v, ok := m[s.key]; ok && s.index < 0 {
+		return []interface{}{v}
+	}
+	return nil
+}
+
+// propertyNames are the AMQP properties that can be filtered on
+var propertyNames = map[string]bool{
+	"content_type": true, "content_encoding": true, "delivery_mode": true,
+	"priority": true, "correlation_id": true, "reply_to": true,
+	"expiration": true, "message_id": true, "timestamp": true,
+	"type": true, "user_id": true, "app_id": true,
+}
+
+// property returns the AMQP property by its name, when set
+func property(p *rmq.Properties, name string) (interface{}, bool) {
+	var v interface{}
+	switch name {
+	case "content_type":
+		v = p.ContentType
+	case "content_encoding":
+		v = p.ContentEncoding
+	case "correlation_id":
+		v = p.CorrelationID
+	case "reply_to":
+		v = p.ReplyTo
+	case "expiration":
+		v = p.Expiration
+	case "message_id":
+		v = p.MessageID
+	case "type":
+		v = p.Type
+	case "user_id":
+		v = p.UserID
+	case "app_id":
+		v = p.AppID
+	case "delivery_mode":
+		return p.DeliveryMode, p.DeliveryMode != 0
+	case "priority":
+		return p.Priority, p.Priority != 0
+	case "timestamp":
+		return p.Timestamp, !p.Timestamp.IsZero()
+	default:
+		return nil, false
+	}
+	return v, v != ""
+}
@@ -0,0 +1,158 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMessage() *rmq.Message {
+	return &rmq.Message{
+		Body:       []byte(`{"customer": {"email": "jane@example.com", "country": "SE"}, "items": [{"sku": "a", "qty": 2}, {"sku": "b", "qty": 5}], "paid": true}`),
+		RoutingKey: "orders.created",
+		Headers: amqp.Table{
+			"retries":    int64(3),
+			"source":     "web",
+			"my.header":  "dotted",
+			"flagged":    false,
+			"price":      amqp.Decimal{Scale: 2, Value: 1999},
+			"created_at": time.Unix(1523456789, 0),
+			"x-death": []interface{}{amqp.Table{
+				"count":  int64(2),
+				"reason": "rejected",
+				"queue":  "orders",
+			}},
+		},
+		Properties: rmq.Properties{
+			ContentType:  "application/json",
+			DeliveryMode: 2,
+			Priority:     5,
+			MessageID:    "order-1",
+			Timestamp:    time.Unix(1523456789, 0),
+		},
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`routingkey == "orders.created"`, true},
+		{`routing_key != "orders.created"`, false},
+		{`routingkey =~ "^orders\\."`, true},
+		{`routingkey !~ "^orders\\."`, false},
+		{`size > 10`, true},
+		{`size <= 10`, false},
+		{`body =~ "jane@example"`, true},
+		{`body`, true},
+		{`headers.retries >= 3`, true},
+		{`headers.retries > 3`, false},
+		{`headers.source == "web" and headers.retries == 3`, true},
+		{`headers.source == "api" || headers.retries == 3`, true},
+		{`headers.my.header == "dotted"`, true},
+		{`headers["my.header"] == "dotted"`, true},
+		{`headers.missing`, false},
+		{`not headers.missing`, true},
+		{`headers.missing != "x"`, true},
+		{`headers.missing == "x"`, false},
+		{`headers.flagged`, false},
+		{`headers.flagged == false`, true},
+		{`headers.price == 19.99`, true},
+		{`headers.created_at > 1500000000`, true},
+		{`headers.x-death`, true},
+		{`headers["x-death"][0]["count"] >= 2`, true},
+		{`headers.x-death[0]["reason"] == "rejected"`, true},
+		{`headers.x-death[*]["queue"] == "orders"`, true},
+		{`headers.x-death[1]["queue"] == "orders"`, false},
+		{`properties.content_type == "application/json"`, true},
+		{`properties.priority >= 5 and properties.delivery_mode == 2`, true},
+		{`properties.message_id =~ "^order-"`, true},
+		{`properties.timestamp < 1600000000`, true},
+		{`properties.reply_to`, false},
+		{`$.customer.country == "SE"`, true},
+		{`$.customer.email =~ "@example\\.com$"`, true},
+		{`$["customer"]["country"] == 'SE'`, true},
+		{`$.items[1].qty == 5`, true},
+		{`$.items[*].sku == "b"`, true},
+		{`$.items[*].sku != "c"`, true},
+		{`$.items[*].qty > 10`, false},
+		{`$.paid`, true},
+		{`$.paid == true`, true},
+		{`$.missing`, false},
+		{`not (routingkey == "orders.created" and $.paid)`, false},
+		{`!($.customer.country == "NO") && (size > 1 || headers.missing)`, true},
+		{`headers.retries == "3"`, false},
+	}
+
+	m := testMessage()
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := Parse(tt.expr)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.match, f.Match(m))
+		})
+	}
+}
+
+func TestFilter_NotJSONBody(t *testing.T) {
+	f, _ := Parse(`$.customer`)
+	m := &rmq.Message{Body: []byte("not json")}
+
+	assert.False(t, f.Match(m), "should not match a body that is not JSON")
+}
+
+func TestFilter_Nil(t *testing.T) {
+	var f *Filter
+
+	assert.True(t, f.Match(testMessage()), "should match all messages without a filter")
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []string{
+		``,
+		`routingkey ==`,
+		`routingkey == "unterminated`,
+		`unknown == 1`,
+		`size.bytes > 1`,
+		`headers == 1`,
+		`properties.unknown == 1`,
+		`routingkey =~ "("`,
+		`routingkey =~ 1`,
+		`(routingkey == "a"`,
+		`routingkey == "a")`,
+		`routingkey == "a" and`,
+		`routingkey == maybe`,
+		`headers.a[x] == 1`,
+		`headers.x-death[0].count >= 2`,
+		`size > 1 # comment`,
+		`headers[`,
+		`$[`,
+		`headers["a"][`,
+		`$.items[0`,
+	}
+
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			_, err := Parse(expr)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenType is the kind of a token in a filter expression
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLeftParen
+	tokenRightParen
+)
+
+// token is a lexical token with its position in the expression
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// operators in the order they are matched, longest first
+var operators = []string{"==", "!=", "<=", ">=", "=~", "!~", "<", ">"}
+
+// lex splits a filter expression into tokens
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+
+	for i < len(expr) {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '(':
+			tokens = append(tokens, token{tokenLeftParen, "(", i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{tokenRightParen, ")", i})
+			i++
+
+		case c == '"' || c == '\'':
+			s, n, err := lexString(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %s", i, err)
+			}
+			tokens = append(tokens, token{tokenString, s, i})
+			i += n
+
+		case c == '$':
+			n := lexPath(expr[i:])
+			tokens = append(tokens, token{tokenPath, expr[i : i+n], i})
+			i += n
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			n := 1
+			for i+n < len(expr) && strings.ContainsRune("0123456789.eE+-", rune(expr[i+n])) {
+				n++
+			}
+			if _, err := strconv.ParseFloat(expr[i:i+n], 64); err != nil {
+				return nil, fmt.Errorf("at %d: invalid number %q", i, expr[i:i+n])
+			}
+			tokens = append(tokens, token{tokenNumber, expr[i : i+n], i})
+			i += n
+
+		case strings.HasPrefix(expr[i:], "&&"):
+			tokens = append(tokens, token{tokenAnd, "&&", i})
+			i += 2
+
+		case strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, token{tokenOr, "||", i})
+			i += 2
+
+		case isIdentStart(c):
+			n := lexIdent(expr[i:])
+			word := expr[i : i+n]
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, token{tokenAnd, word, i})
+			case "or":
+				tokens = append(tokens, token{tokenOr, word, i})
+			case "not":
+				tokens = append(tokens, token{tokenNot, word, i})
+			default:
+				tokens = append(tokens, token{tokenIdent, word, i})
+			}
+			i += n
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			switch {
+			case op != "":
+				tokens = append(tokens, token{tokenOperator, op, i})
+				i += len(op)
+			case c == '!':
+				tokens = append(tokens, token{tokenNot, "!", i})
+				i++
+			default:
+				return nil, fmt.Errorf("at %d: unexpected character %q", i, c)
+			}
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(expr)}), nil
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+// lexIdent returns the length of an identifier like headers.x-death or
+// headers["my header"]
+func lexIdent(s string) int {
+	n := 0
+	for n < len(s) {
+		c := rune(s[n])
+		switch {
+		case c == '_' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			n++
+		case c == '[':
+			n += lexBracket(s[n:])
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// lexPath returns the length of a JSONPath like $.a.b[0]["c d"]
+func lexPath(s string) int {
+	n := 1
+	for n < len(s) {
+		c := rune(s[n])
+		switch {
+		case c == '_' || c == '-' || c == '.' || c == '*' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			n++
+		case c == '[':
+			n += lexBracket(s[n:])
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// lexBracket returns the length of a [...] selector, quoted keys may contain ]
+func lexBracket(s string) int {
+	n := 1
+	for n < len(s) {
+		switch s[n] {
+		case '"', '\'':
+			if _, l, err := lexString(s[n:]); err == nil {
+				n += l
+				continue
+			}
+			return len(s)
+		case ']':
+			return n + 1
+		}
+		n++
+	}
+	return n
+}
+
+// lexString returns the unquoted string literal at the start of s and its
+// length in s, double quoted strings support Go escapes
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	for n := 1; n < len(s); n++ {
+		switch s[n] {
+		case '\\':
+			n++
+		case quote:
+			if quote == '\'' {
+				return strings.Replace(s[1:n], `\'`, `'`, -1), n + 1, nil
+			}
+			v, err := strconv.Unquote(s[:n+1])
+			return v, n + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %s", s)
+}
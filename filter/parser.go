@@ -0,0 +1,282 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parser is a recursive descent parser of filter expressions:
+//
+//	expr    = and { ("or" | "||") and }
+//	and     = unary { ("and" | "&&") unary }
+//	unary   = ("not" | "!") unary | primary
+//	primary = "(" expr ")" | operand [ operator literal ]
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tokenAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek().typ == tokenNot {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenLeftParen:
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.typ != tokenRightParen {
+			return nil, fmt.Errorf("at %d: expected ) but found %q", r.pos, r.val)
+		}
+		return n, nil
+
+	case tokenIdent, tokenPath:
+		o, err := parseOperand(t)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().typ != tokenOperator {
+			return &existsNode{o}, nil
+		}
+		op := p.next()
+		return p.parseComparison(o, op)
+	}
+	return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.val)
+}
+
+func (p *parser) parseComparison(o *operand, op token) (node, error) {
+	t := p.next()
+	c := &compareNode{operand: o, op: op.val}
+
+	switch t.typ {
+	case tokenString:
+		c.literal = t.val
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: invalid number %q", t.pos, t.val)
+		}
+		c.literal = f
+	case tokenIdent:
+		b, err := strconv.ParseBool(t.val)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: expected a string, number or boolean but found %q", t.pos, t.val)
+		}
+		c.literal = b
+	default:
+		return nil, fmt.Errorf("at %d: expected a value after %s", t.pos, op.val)
+	}
+
+	if op.val == "=~" || op.val == "!~" {
+		s, ok := c.literal.(string)
+		if !ok {
+			return nil, fmt.Errorf("at %d: %s needs a regular expression string", t.pos, op.val)
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: %s", t.pos, err)
+		}
+		c.regexp = re
+	}
+	return c, nil
+}
+
+// parseOperand parses the message field an identifier or JSONPath refers to
+func parseOperand(t token) (*operand, error) {
+	if t.typ == tokenPath {
+		selectors, err := parseSelectors(t.val[1:], true)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: %s", t.pos, err)
+		}
+		return &operand{field: fieldJSON, selectors: selectors}, nil
+	}
+
+	name := t.val
+	rest := ""
+	if i := strings.IndexAny(name, ".["); i >= 0 {
+		name, rest = t.val[:i], t.val[i:]
+	}
+
+	o := &operand{}
+	switch strings.ToLower(name) {
+	case "routingkey", "routing_key":
+		o.field = fieldRoutingKey
+	case "size":
+		o.field = fieldSize
+	case "body":
+		o.field = fieldBody
+	case "headers", "header":
+		o.field = fieldHeaders
+	case "properties", "property":
+		o.field = fieldProperties
+	default:
+		return nil, fmt.Errorf("at %d: unknown field %q, expected routingkey, size, body, headers, properties or a $ JSONPath", t.pos, t.val)
+	}
+
+	if o.field != fieldHeaders && o.field != fieldProperties {
+		if rest != "" {
+			return nil, fmt.Errorf("at %d: %s has no fields", t.pos, name)
+		}
+		return o, nil
+	}
+
+	// the header or property name may contain dots, unless quoted in brackets
+	switch {
+	case strings.HasPrefix(rest, "."):
+		end := strings.Index(rest, "[")
+		if end < 0 {
+			end = len(rest)
+		}
+		o.name, rest = rest[1:end], rest[end:]
+	case strings.HasPrefix(rest, "["):
+		selectors, err := parseSelectors(rest, false)
+		if err != nil || len(selectors) == 0 || selectors[0].index >= 0 {
+			return nil, fmt.Errorf("at %d: expected %s[\"name\"]", t.pos, name)
+		}
+		o.name = selectors[0].key
+		o.selectors = selectors[1:]
+		rest = ""
+	}
+	if o.name == "" {
+		return nil, fmt.Errorf("at %d: %s needs a name, like %s.name", t.pos, name, name)
+	}
+	if o.field == fieldProperties {
+		if !propertyNames[o.name] {
+			return nil, fmt.Errorf("at %d: unknown property %q", t.pos, o.name)
+		}
+		if rest != "" {
+			return nil, fmt.Errorf("at %d: properties have no fields", t.pos)
+		}
+	}
+
+	selectors, err := parseSelectors(rest, false)
+	if err != nil {
+		return nil, fmt.Errorf("at %d: %s", t.pos, err)
+	}
+	o.selectors = append(o.selectors, selectors...)
+	return o, nil
+}
+
+// parseSelectors parses .key, [0], [*] and ["key"] selectors, dotted keys
+// are only allowed in JSONPaths
+func parseSelectors(s string, dotted bool) ([]selector, error) {
+	var selectors []selector
+	for len(s) > 0 {
+		switch {
+		case s[0] == '.' && dotted:
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			key := s[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in %q", s)
+			}
+			if key == "*" {
+				selectors = append(selectors, selector{index: -1, wildcard: true})
+			} else {
+				selectors = append(selectors, selector{key: key, index: -1})
+			}
+			s = s[end+1:]
+
+		case s[0] == '[':
+			end := lexBracket(s)
+			if end < 2 || s[end-1] != ']' {
+				return nil, fmt.Errorf("unterminated selector %q", s)
+			}
+			inner := s[1 : end-1]
+			switch {
+			case inner == "*":
+				selectors = append(selectors, selector{index: -1, wildcard: true})
+			case strings.HasPrefix(inner, `"`) || strings.HasPrefix(inner, `'`):
+				key, n, err := lexString(inner)
+				if err != nil || n != len(inner) {
+					return nil, fmt.Errorf("invalid key %s", inner)
+				}
+				selectors = append(selectors, selector{key: key, index: -1})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("invalid index %s", inner)
+				}
+				selectors = append(selectors, selector{index: i})
+			}
+			s = s[end:]
+
+		default:
+			return nil, fmt.Errorf("unexpected %q", s)
+		}
+	}
+	return selectors, nil
+}
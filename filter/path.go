@@ -0,0 +1,85 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Path is a JSONPath like $.customer.email or $.items[*].card, selecting
+// values in a JSON document like in filter expressions
+type Path struct {
+	expr      string
+	selectors []selector
+}
+
+// ParsePath parses a JSONPath selecting at least one key or index
+func ParsePath(expr string) (*Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("invalid path %q: expected a JSONPath starting with $", expr)
+	}
+	selectors, err := parseSelectors(expr[1:], true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %s", expr, err)
+	}
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("invalid path %q: selects the whole document", expr)
+	}
+	return &Path{expr: expr, selectors: selectors}, nil
+}
+
+// String returns the JSONPath
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Replace replaces the values selected in the decoded JSON document v by
+// the result of fn, and returns the number of replaced values
+func (p *Path) Replace(v interface{}, fn func(interface{}) interface{}) int {
+	return replace(v, p.selectors, fn)
+}
+
+// replace applies the last selector by setting the value in its object or
+// array, and the others by selecting the values to continue in
+func replace(v interface{}, selectors []selector, fn func(interface{}) interface{}) int {
+	s := selectors[0]
+	if len(selectors) > 1 {
+		var n int
+		for _, child := range s.apply(v) {
+			n += replace(child, selectors[1:], fn)
+		}
+		return n
+	}
+
+	var n int
+	switch fv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range fv {
+			if s.wildcard || (s.index < 0 && k == s.key) {
+				fv[k] = fn(child)
+				n++
+			}
+		}
+	case []interface{}:
+		for i, child := range fv {
+			if s.wildcard || i == s.index {
+				fv[i] = fn(child)
+				n++
+			}
+		}
+	}
+	return n
+}
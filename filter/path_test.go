@@ -0,0 +1,55 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPath_Replace(t *testing.T) {
+	tests := []struct {
+		path string
+		n    int
+		want string
+	}{
+		{"$.customer.email", 1, `{"customer":{"email":"x","name":"Ann"},"items":[{"card":"4111"},{"card":"5500"}]}`},
+		{"$.items[*].card", 2, `{"customer":{"email":"ann@example.com","name":"Ann"},"items":[{"card":"x"},{"card":"x"}]}`},
+		{"$.items[1]", 1, `{"customer":{"email":"ann@example.com","name":"Ann"},"items":[{"card":"4111"},"x"]}`},
+		{"$.customer.*", 2, `{"customer":{"email":"x","name":"x"},"items":[{"card":"4111"},{"card":"5500"}]}`},
+		{`$["customer"]["phone"]`, 0, `{"customer":{"email":"ann@example.com","name":"Ann"},"items":[{"card":"4111"},{"card":"5500"}]}`},
+	}
+	for _, tt := range tests {
+		var doc interface{}
+		json.Unmarshal([]byte(`{"customer":{"email":"ann@example.com","name":"Ann"},"items":[{"card":"4111"},{"card":"5500"}]}`), &doc)
+		p, err := ParsePath(tt.path)
+		assert.NoError(t, err, tt.path)
+
+		n := p.Replace(doc, func(interface{}) interface{} { return "x" })
+		b, _ := json.Marshal(doc)
+
+		assert.Equal(t, tt.n, n, tt.path)
+		assert.Equal(t, tt.want, string(b), tt.path)
+	}
+}
+
+func TestParsePath_Invalid(t *testing.T) {
+	for _, path := range []string{"customer.email", "$", "$.", "$.items[x]", "$[", `$["a"][`} {
+		_, err := ParsePath(path)
+		assert.Error(t, err, path)
+	}
+}
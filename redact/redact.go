@@ -0,0 +1,291 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact removes and masks sensitive data in messages by rules like
+//
+//	drop header authorization
+//	hash header x-user-*
+//	mask json $.customer.email
+//	hash json $.items[*].card
+//	mask body [0-9]{13,16}
+//
+// Headers are selected by name, case insensitive with * and ? wildcards, and
+// dropped, hashed or masked. JSON bodies are changed at JSONPaths like in
+// filter expressions, and masks replace the regular expression matches in
+// bodies. Masked values are replaced by ***, and hashed values by
+// hmac-sha256: and the hex HMAC-SHA256 of the value with a secret key, so
+// equal values can still be correlated but not guessed without the key
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/meltwater/rabbitio/filter"
+	"github.com/meltwater/rabbitio/rmq"
+)
+
+// Mask replaces masked values
+const Mask = "***"
+
+// MinKeyLength is the shortest key hash rules accept
+const MinKeyLength = 16
+
+// Rule is a parsed redaction rule
+type Rule struct {
+	expr   string
+	action string
+	target string
+	header string
+	path   *filter.Path
+	re     *regexp.Regexp
+}
+
+// ParseRule parses a rule of an action, a target and its argument
+func ParseRule(expr string) (*Rule, error) {
+	expr = strings.TrimSpace(expr)
+	action, rest := cut(expr)
+	target, arg := cut(rest)
+	r := &Rule{expr: expr, action: strings.ToLower(action), target: strings.ToLower(target)}
+	if arg == "" {
+		return nil, fmt.Errorf("invalid rule %q: expected an action, a target and its argument like drop header authorization", expr)
+	}
+
+	switch r.target + " " + r.action {
+	case "header drop", "header hash", "header mask":
+		if _, err := path.Match(arg, ""); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", expr, err)
+		}
+		r.header = strings.ToLower(arg)
+	case "json hash", "json mask":
+		p, err := filter.ParsePath(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", expr, err)
+		}
+		r.path = p
+	case "body mask":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", expr, err)
+		}
+		r.re = re
+	default:
+		return nil, fmt.Errorf("invalid rule %q: expected drop, hash or mask header, hash or mask json, or mask body", expr)
+	}
+	return r, nil
+}
+
+// cut returns the first word of s and the rest
+func cut(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// String returns the rule
+func (r *Rule) String() string {
+	return r.expr
+}
+
+// Redactor applies rules to messages in order
+type Redactor struct {
+	rules []*Rule
+	key   []byte
+}
+
+// Parse parses the rules, one per line, skipping empty lines and # comments.
+// The key is needed by hash rules, to hash the values with HMAC-SHA256
+func Parse(rules []string, key []byte) (*Redactor, error) {
+	rd := &Redactor{key: key}
+	for _, lines := range rules {
+		for _, line := range strings.Split(lines, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := ParseRule(line)
+			if err != nil {
+				return nil, err
+			}
+			if r.action == "hash" && len(key) < MinKeyLength {
+				return nil, fmt.Errorf("invalid rule %q: %w", line, ErrKey)
+			}
+			rd.rules = append(rd.rules, r)
+		}
+	}
+	return rd, nil
+}
+
+// ErrKey is returned for hash rules without a key long enough
+var ErrKey = errors.New("hash rules need a key of at least 16 bytes")
+
+// KeyID identifies the key of the hash rules without revealing it, empty
+// without a key
+func (rd *Redactor) KeyID() string {
+	if rd == nil || len(rd.key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(rd.key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Rules returns the rules of the Redactor
+func (rd *Redactor) Rules() []string {
+	if rd == nil {
+		return nil
+	}
+	rules := make([]string, len(rd.rules))
+	for i, r := range rd.rules {
+		rules[i] = r.expr
+	}
+	return rules
+}
+
+// Redact applies the rules to the message and adds the rules that changed
+// it to its Redacted rules, a nil Redactor leaves the message unchanged
+func (rd *Redactor) Redact(m *rmq.Message) {
+	if rd == nil {
+		return
+	}
+	b := &body{raw: m.Body}
+	for _, r := range rd.rules {
+		var changed bool
+		switch r.target {
+		case "header":
+			changed = r.redactHeaders(m, rd.key)
+		case "json":
+			changed = r.redactJSON(b, rd.key)
+		case "body":
+			changed = r.redactBody(b)
+		}
+		if changed {
+			m.Redacted = append(m.Redacted, r.expr)
+		}
+	}
+	m.Body = b.bytes()
+}
+
+// redactHeaders drops, hashes or masks the matching headers
+func (r *Rule) redactHeaders(m *rmq.Message, key []byte) bool {
+	var changed bool
+	for k, v := range m.Headers {
+		if ok, _ := path.Match(r.header, strings.ToLower(k)); !ok {
+			continue
+		}
+		switch r.action {
+		case "drop":
+			delete(m.Headers, k)
+		case "hash":
+			m.Headers[k] = hash(key, v)
+		case "mask":
+			m.Headers[k] = Mask
+		}
+		changed = true
+	}
+	return changed
+}
+
+// redactJSON hashes or masks the values at the path of a JSON body
+func (r *Rule) redactJSON(b *body, key []byte) bool {
+	doc, ok := b.json()
+	if !ok {
+		return false
+	}
+	n := r.path.Replace(doc, func(v interface{}) interface{} {
+		if r.action == "hash" {
+			return hash(key, v)
+		}
+		return Mask
+	})
+	if n > 0 {
+		b.changed = true
+	}
+	return n > 0
+}
+
+// redactBody masks the matches of the regular expression in the body
+func (r *Rule) redactBody(b *body) bool {
+	raw := b.bytes()
+	if !r.re.Match(raw) {
+		return false
+	}
+	b.raw = r.re.ReplaceAllLiteral(raw, []byte(Mask))
+	b.doc, b.decoded = nil, false
+	return true
+}
+
+// hash returns hmac-sha256: and the hex HMAC-SHA256 of the value with the
+// key, of the JSON of values other than text
+func hash(key []byte, v interface{}) string {
+	var b []byte
+	switch fv := v.(type) {
+	case string:
+		b = []byte(fv)
+	case []byte:
+		b = fv
+	default:
+		b, _ = json.Marshal(fv)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// body is a message body, decoded as JSON when needed by a rule and
+// encoded again after a change
+type body struct {
+	raw     []byte
+	doc     interface{}
+	decoded bool
+	changed bool
+}
+
+// json returns the decoded JSON body, and false when it is not JSON
+func (b *body) json() (interface{}, bool) {
+	if !b.decoded {
+		b.decoded = true
+		d := json.NewDecoder(bytes.NewReader(b.raw))
+		d.UseNumber()
+		if err := d.Decode(&b.doc); err != nil || d.More() {
+			b.doc = nil
+		}
+	}
+	return b.doc, b.doc != nil
+}
+
+// bytes returns the body, encoding the changed JSON body
+func (b *body) bytes() []byte {
+	if b.changed {
+		var buf bytes.Buffer
+		e := json.NewEncoder(&buf)
+		e.SetEscapeHTML(false)
+		if err := e.Encode(b.doc); err == nil {
+			b.raw = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		}
+		b.changed = false
+		b.decoded = false
+	}
+	return b.raw
+}
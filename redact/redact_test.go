@@ -0,0 +1,121 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/meltwater/rabbitio/rmq"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func message() *rmq.Message {
+	return &rmq.Message{
+		Body: []byte(`{"customer":{"email":"ann@example.com","name":"Ann <3"},"card":"4111111111111111","total":12.50}`),
+		Headers: amqp.Table{
+			"Authorization": "Bearer secret",
+			"x-user-id":     "42",
+			"x-user-roles":  []interface{}{"admin"},
+			"retries":       int64(3),
+		},
+	}
+}
+
+// key is the key of the hash rules in the tests
+var key = []byte("0123456789abcdef")
+
+func TestRedactor_Redact(t *testing.T) {
+	rd, err := Parse([]string{`
+		# headers
+		drop header authorization
+		hash header x-user-*
+		mask json $.customer.email
+		mask body [0-9]{13,16}
+		mask header x-missing
+	`}, key)
+	assert.NoError(t, err)
+
+	m := message()
+	rd.Redact(m)
+
+	assert.Equal(t, `{"card":"***","customer":{"email":"***","name":"Ann <3"},"total":12.50}`, string(m.Body))
+	assert.NotContains(t, m.Headers, "Authorization")
+	assert.Equal(t, "hmac-sha256:8d24a2a526d5f556469db8b6280e3a7b877a41155ca536be3a1f2a9d2be0eacd", m.Headers["x-user-id"])
+	assert.Contains(t, m.Headers["x-user-roles"], "hmac-sha256:")
+	assert.Equal(t, int64(3), m.Headers["retries"])
+	assert.Equal(t, []string{
+		"drop header authorization",
+		"hash header x-user-*",
+		"mask json $.customer.email",
+		"mask body [0-9]{13,16}",
+	}, m.Redacted, "should record the rules that changed the message")
+}
+
+func TestRedactor_RedactNotJSON(t *testing.T) {
+	rd, _ := Parse([]string{"hash json $.email", "mask body secret"}, key)
+	m := &rmq.Message{Body: []byte("my secret is not JSON")}
+
+	rd.Redact(m)
+
+	assert.Equal(t, "my *** is not JSON", string(m.Body))
+	assert.Equal(t, []string{"mask body secret"}, m.Redacted)
+}
+
+func TestRedactor_Nil(t *testing.T) {
+	var rd *Redactor
+	m := message()
+
+	rd.Redact(m)
+
+	assert.Equal(t, message(), m)
+	assert.Nil(t, rd.Rules())
+}
+
+func TestParseRule_Invalid(t *testing.T) {
+	for _, rule := range []string{
+		"drop header",
+		"drop json $.email",
+		"hash body secret",
+		"mask json email",
+		"mask body [",
+		"remove header x",
+	} {
+		_, err := ParseRule(rule)
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestParse_Key(t *testing.T) {
+	_, err := Parse([]string{"hash header x-user-id"}, nil)
+	assert.True(t, errors.Is(err, ErrKey), "should need a key to hash")
+	_, err = Parse([]string{"hash header x-user-id"}, []byte("short"))
+	assert.True(t, errors.Is(err, ErrKey), "should need a key long enough")
+
+	rd, err := Parse([]string{"mask header x-user-id"}, nil)
+	assert.NoError(t, err, "should only need a key to hash")
+	assert.Empty(t, rd.KeyID())
+
+	rd, _ = Parse([]string{"hash header x-user-id"}, key)
+	assert.Equal(t, "9f9f5111f7b27a78", rd.KeyID())
+}
+
+func TestRedactor_Rules(t *testing.T) {
+	rd, _ := Parse([]string{"drop header a", "mask   body  a b"}, nil)
+
+	assert.Equal(t, []string{"drop header a", "mask   body  a b"}, rd.Rules())
+	assert.Equal(t, "a b", rd.rules[1].re.String(), "should keep spaces in the argument")
+}
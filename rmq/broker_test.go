@@ -0,0 +1,380 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// broker stands in for RabbitMQ with a single queue, speaking just enough of
+// AMQP 0-9-1 to consume from it and publish with confirms: deliveries are
+// limited by the prefetch, nacked and unacked messages are requeued at the
+// head of the queue. Published messages starting with return are returned as
+// unroutable and those starting with nack are nacked
+type broker struct {
+	lock      sync.Mutex
+	queue     []brokerMessage
+	acked     []string
+	published []string
+	prefetch  int
+	conns     map[*brokerConn]net.Conn
+	uri       string
+}
+
+type brokerMessage struct {
+	body        string
+	redelivered bool
+}
+
+// newBroker starts a broker with the messages in its queue
+func newBroker(t *testing.T, bodies ...string) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	b := &broker{uri: "amqp://guest:guest@" + l.Addr().String() + "/", conns: make(map[*brokerConn]net.Conn)}
+	for _, body := range bodies {
+		b.queue = append(b.queue, brokerMessage{body: body})
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// Acked returns the bodies of the acked messages
+func (b *broker) Acked() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.acked...)
+}
+
+// Drop closes the client connections like a lost connection, requeueing
+// their unacked messages
+func (b *broker) Drop() {
+	b.lock.Lock()
+	conns := make(map[*brokerConn]net.Conn)
+	for c, conn := range b.conns {
+		conns[c] = conn
+	}
+	b.lock.Unlock()
+	for c, conn := range conns {
+		conn.Close()
+		c.requeue(0, true)
+	}
+}
+
+// Push adds messages to the tail of the queue
+func (b *broker) Push(bodies ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, body := range bodies {
+		b.queue = append(b.queue, brokerMessage{body: body})
+	}
+}
+
+// Published returns the bodies of the published messages that were acked
+func (b *broker) Published() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.published...)
+}
+
+// Queued returns the bodies of the messages left in the queue
+func (b *broker) Queued() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var queued []string
+	for _, m := range b.queue {
+		queued = append(queued, m.body)
+	}
+	return queued
+}
+
+// frame is an AMQP frame
+type frame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+// args builds and reads the arguments of methods
+type args []byte
+
+func (a args) short(v uint16) args    { return binary.BigEndian.AppendUint16(a, v) }
+func (a args) long(v uint32) args     { return binary.BigEndian.AppendUint32(a, v) }
+func (a args) longlong(v uint64) args { return binary.BigEndian.AppendUint64(a, v) }
+func (a args) shortstr(s string) args { return append(append(a, byte(len(s))), s...) }
+func (a args) longstr(s string) args  { return append(a.long(uint32(len(s))), s...) }
+
+func (a *args) readShortstr() string {
+	n := int((*a)[0])
+	s := string((*a)[1 : 1+n])
+	*a = (*a)[1+n:]
+	return s
+}
+
+// brokerConn is the state of a client connection
+type brokerConn struct {
+	*broker
+	w        *bufio.Writer
+	tag      string
+	next     uint64
+	unacked  map[uint64]brokerMessage
+	order    []uint64
+	channel  uint16
+	consumer bool
+	confirm  bool
+	seq      uint64
+	pub      *brokerPublish
+}
+
+// brokerPublish is a published message waiting for its content
+type brokerPublish struct {
+	exchange  string
+	key       string
+	mandatory bool
+	size      uint64
+	body      []byte
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := &brokerConn{broker: b, w: bufio.NewWriter(conn), unacked: make(map[uint64]brokerMessage)}
+	b.lock.Lock()
+	b.conns[c] = conn
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.conns, c)
+		b.lock.Unlock()
+		c.requeue(0, true)
+	}()
+
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	c.method(0, 10, 10, args{0, 9}.long(0).longstr("PLAIN").longstr("en_US"))
+	c.w.Flush()
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if f.kind == 2 || f.kind == 3 {
+			c.content(f)
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+			continue
+		}
+		if f.kind != 1 {
+			continue
+		}
+		class := binary.BigEndian.Uint16(f.payload)
+		method := binary.BigEndian.Uint16(f.payload[2:])
+		a := args(f.payload[4:])
+		switch {
+		case class == 10 && method == 11: // start-ok
+			c.method(0, 10, 30, args{}.short(2047).long(131072).short(0))
+		case class == 10 && method == 40: // open
+			c.method(0, 10, 41, args{}.shortstr(""))
+		case class == 10 && method == 50: // close
+			c.method(0, 10, 51, nil)
+			c.w.Flush()
+			return
+		case class == 20 && method == 10: // channel open
+			c.channel = f.channel
+			c.method(f.channel, 20, 11, args{}.longstr(""))
+		case class == 20 && method == 40: // channel close
+			c.requeue(0, true)
+			c.consumer = false
+			c.method(f.channel, 20, 41, nil)
+		case class == 40 && method == 10: // exchange declare
+			c.method(f.channel, 40, 11, nil)
+		case class == 85 && method == 10: // confirm select
+			c.confirm = true
+			c.method(f.channel, 85, 11, nil)
+		case class == 60 && method == 40: // publish
+			a = a[2:]
+			c.pub = &brokerPublish{exchange: a.readShortstr(), key: a.readShortstr()}
+			c.pub.mandatory = a[0]&1 != 0
+		case class == 60 && method == 10: // qos
+			b.lock.Lock()
+			b.prefetch = int(binary.BigEndian.Uint16(a[4:]))
+			b.lock.Unlock()
+			c.method(f.channel, 60, 11, nil)
+		case class == 50 && method == 10: // queue declare
+			a = a[2:]
+			name := a.readShortstr()
+			b.lock.Lock()
+			n := len(b.queue)
+			b.lock.Unlock()
+			c.method(f.channel, 50, 11, args{}.shortstr(name).long(uint32(n)).long(0))
+		case class == 50 && method == 20: // queue bind
+			c.method(f.channel, 50, 21, nil)
+		case class == 60 && method == 20: // consume
+			a = a[2:]
+			a.readShortstr()
+			c.tag = a.readShortstr()
+			c.consumer = true
+			c.method(f.channel, 60, 21, args{}.shortstr(c.tag))
+		case class == 60 && method == 80: // ack
+			c.ack(binary.BigEndian.Uint64(a), a[8]&1 != 0)
+		case class == 60 && method == 120: // nack
+			c.requeue(binary.BigEndian.Uint64(a), a[8]&1 != 0)
+		}
+		c.deliver()
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// content reads the header and body frames of a published message
+func (c *brokerConn) content(f frame) {
+	if c.pub == nil {
+		return
+	}
+	if f.kind == 2 {
+		c.pub.size = binary.BigEndian.Uint64(f.payload[4:])
+	} else {
+		c.pub.body = append(c.pub.body, f.payload...)
+	}
+	if uint64(len(c.pub.body)) >= c.pub.size {
+		c.publish(c.pub)
+		c.pub = nil
+	}
+}
+
+// publish returns or nacks the message by its body, or acks it as published
+func (c *brokerConn) publish(p *brokerPublish) {
+	c.seq++
+	body := string(p.body)
+	switch {
+	case strings.HasPrefix(body, "return") && p.mandatory:
+		c.method(c.channel, 60, 50, args{}.short(312).shortstr("NO_ROUTE").shortstr(p.exchange).shortstr(p.key))
+		c.frame(2, c.channel, args{}.short(60).short(0).longlong(uint64(len(p.body))).short(0))
+		c.frame(3, c.channel, p.body)
+	case strings.HasPrefix(body, "nack"):
+		if c.confirm {
+			c.method(c.channel, 60, 120, append(args{}.longlong(c.seq), 0))
+		}
+		return
+	default:
+		c.lock.Lock()
+		c.published = append(c.published, body)
+		c.lock.Unlock()
+	}
+	if c.confirm {
+		c.method(c.channel, 60, 80, append(args{}.longlong(c.seq), 0))
+	}
+}
+
+// deliver sends messages from the queue while the prefetch allows
+func (c *brokerConn) deliver() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.consumer && len(c.queue) > 0 && (c.prefetch == 0 || len(c.unacked) < c.prefetch) {
+		m := c.queue[0]
+		c.queue = c.queue[1:]
+		c.next++
+		c.unacked[c.next] = m
+		c.order = append(c.order, c.next)
+
+		redelivered := byte(0)
+		if m.redelivered {
+			redelivered = 1
+		}
+		deliver := args{}.shortstr(c.tag).longlong(c.next)
+		c.method(c.channel, 60, 60, append(deliver, redelivered).shortstr("").shortstr("key"))
+		c.frame(2, c.channel, args{}.short(60).short(0).longlong(uint64(len(m.body))).short(0))
+		c.frame(3, c.channel, []byte(m.body))
+	}
+}
+
+// settled removes the delivery tags up to tag, or only tag, from unacked
+func (c *brokerConn) settled(tag uint64, multiple bool) []brokerMessage {
+	var settled []brokerMessage
+	var order []uint64
+	for _, t := range c.order {
+		if t == tag || (multiple && (tag == 0 || t <= tag)) {
+			settled = append(settled, c.unacked[t])
+			delete(c.unacked, t)
+			continue
+		}
+		order = append(order, t)
+	}
+	c.order = order
+	return settled
+}
+
+func (c *brokerConn) ack(tag uint64, multiple bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, m := range c.settled(tag, multiple) {
+		c.acked = append(c.acked, m.body)
+	}
+}
+
+// requeue puts the messages back at the head of the queue, tag 0 with
+// multiple requeues all unacked messages
+func (c *brokerConn) requeue(tag uint64, multiple bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	settled := c.settled(tag, multiple)
+	for i := range settled {
+		settled[i].redelivered = true
+	}
+	c.queue = append(settled, c.queue...)
+}
+
+func (c *brokerConn) method(channel, class, method uint16, a args) {
+	c.frame(1, channel, append(args{}.short(class).short(method), a...))
+}
+
+func (c *brokerConn) frame(kind byte, channel uint16, payload []byte) {
+	header := append(args{kind}.short(channel), args{}.long(uint32(len(payload)))...)
+	c.w.Write(header)
+	c.w.Write(payload)
+	c.w.WriteByte(0xce)
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: payload[:len(payload)-1]}, nil
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// outstanding is a published message waiting for a confirm
+type outstanding struct {
+	tag        uint64
+	routingKey string
+	message    Message
+	returned   *amqp.Return
+}
+
+// confirmTracker keeps the published messages in delivery tag order until
+// they are confirmed, the broker confirms messages on a channel in order
+type confirmTracker struct {
+	tag     uint64
+	pending []*outstanding
+}
+
+// add tracks the next published message on the channel
+func (t *confirmTracker) add(routingKey string, m Message) {
+	t.tag++
+	t.pending = append(t.pending, &outstanding{
+		tag:        t.tag,
+		routingKey: routingKey,
+		message:    m,
+	})
+}
+
+// len is the number of messages waiting for a confirm
+func (t *confirmTracker) len() int {
+	return len(t.pending)
+}
+
+// returned marks the first pending message matching the unroutable message.
+// Returns do not carry a delivery tag, so messages with an identical routing
+// key and body can not be told apart
+func (t *confirmTracker) returned(ret amqp.Return) {
+	for _, o := range t.pending {
+		if o.returned == nil && o.routingKey == ret.RoutingKey && bytes.Equal(o.message.Body, ret.Body) {
+			r := ret
+			o.returned = &r
+			return
+		}
+	}
+}
+
+// confirm settles the message of the confirmation, ok is false for unknown
+// delivery tags. A Failure is returned when the message was nacked or returned
+// as unroutable
+func (t *confirmTracker) confirm(c amqp.Confirmation) (m Message, f *Failure, ok bool) {
+	if len(t.pending) == 0 || t.pending[0].tag != c.DeliveryTag {
+		return m, nil, false
+	}
+	o := t.pending[0]
+	t.pending = t.pending[1:]
+
+	switch {
+	case o.returned != nil:
+		return o.message, &Failure{Message: o.message, Reason: fmt.Sprintf("returned: %d %s", o.returned.ReplyCode, o.returned.ReplyText)}, true
+	case !c.Ack:
+		return o.message, &Failure{Message: o.message, Reason: "nacked by broker"}, true
+	}
+	return o.message, nil, true
+}
+
+// reset returns the messages waiting for a confirm and starts over with the
+// delivery tags of a new channel
+func (t *confirmTracker) reset() []Message {
+	var messages []Message
+	for _, o := range t.pending {
+		messages = append(messages, o.message)
+	}
+	t.tag = 0
+	t.pending = nil
+	return messages
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmTracker(t *testing.T) {
+	assert := assert.New(t)
+	tracker := new(confirmTracker)
+
+	tracker.add("rk", Message{Body: []byte("acked"), Entry: "1.rio"})
+	tracker.add("rk", Message{Body: []byte("nacked"), Entry: "2.rio"})
+	tracker.add("unroutable", Message{Body: []byte("returned"), Entry: "3.rio", Tarball: "data/1_messages_3.tgz"})
+	assert.Equal(3, tracker.len())
+
+	tracker.returned(amqp.Return{RoutingKey: "unroutable", Body: []byte("returned"), ReplyCode: 312, ReplyText: "NO_ROUTE"})
+
+	m, acked, ok := tracker.confirm(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	assert.True(ok)
+	assert.Nil(acked, "should confirm an acked message")
+	assert.Equal("1.rio", m.Entry)
+
+	_, nacked, ok := tracker.confirm(amqp.Confirmation{DeliveryTag: 2, Ack: false})
+	assert.True(ok)
+	assert.Equal("2.rio", nacked.Message.Entry)
+	assert.Equal("nacked by broker", nacked.Reason)
+
+	_, returned, ok := tracker.confirm(amqp.Confirmation{DeliveryTag: 3, Ack: true})
+	assert.True(ok)
+	assert.Equal("3.rio", returned.Message.Entry)
+	assert.Equal("data/1_messages_3.tgz", returned.Message.Tarball)
+	assert.Equal("returned: 312 NO_ROUTE", returned.Reason)
+
+	assert.Equal(0, tracker.len())
+}
+
+func TestConfirmTracker_UnknownTag(t *testing.T) {
+	tracker := new(confirmTracker)
+	tracker.add("rk", Message{Body: []byte("message")})
+
+	_, f, ok := tracker.confirm(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+
+	assert.Nil(t, f)
+	assert.False(t, ok, "should not settle an unknown delivery tag")
+	assert.Equal(t, 1, tracker.len())
+}
+
+func TestConfirmTracker_Reset(t *testing.T) {
+	tracker := new(confirmTracker)
+	tracker.add("rk", Message{Entry: "1.rio"})
+	tracker.add("rk", Message{Entry: "2.rio"})
+
+	messages := tracker.reset()
+	tracker.add("rk", Message{Entry: "1.rio"})
+	_, f, ok := tracker.confirm(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "2.rio", messages[1].Entry)
+	assert.Nil(t, f)
+	assert.True(t, ok, "should restart delivery tags after reset")
+}
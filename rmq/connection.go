@@ -0,0 +1,192 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// errStopped is returned when reconnecting is interrupted by Stop
+var errStopped = fmt.Errorf("%w: stopped while reconnecting", ErrConnection)
+
+// Backoff configures reconnecting to RabbitMQ after the connection is lost
+type Backoff struct {
+	// Attempts is the number of reconnects in a row before giving up, zero
+	// disables reconnecting
+	Attempts int
+	// Min is the delay before the first attempt, doubled for every attempt
+	Min time.Duration
+	// Max is the longest delay between two attempts
+	Max time.Duration
+}
+
+// DefaultBackoff is used by NewConsumer and NewPublisher
+var DefaultBackoff = Backoff{
+	Attempts: 10,
+	Min:      500 * time.Millisecond,
+	Max:      30 * time.Second,
+}
+
+// delay returns the time to wait before the attempt, starting from 1
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// connect dials RabbitMQ, opens a channel and prepares it with the setup of
+// the consumer or publisher. Every channel gets a new channel id, as the
+// delivery tags restart on a new channel
+func (r *RabbitMQ) connect() error {
+	conn, err := r.dial()
+	if err != nil {
+		return fmt.Errorf("%w: failed to connect to Rabbit: %s", ErrConnection, err)
+	}
+
+	closing := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go r.blocking(conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	go func() {
+		if err := <-closing; err != nil {
+			log.Printf("connection closing: %s", err)
+		}
+	}()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		r.release(conn, nil)
+		return fmt.Errorf("%w: failed to get a channel from Rabbit: %s", ErrConnection, err)
+	}
+	if err = r.setup(channel); err != nil {
+		r.release(conn, channel)
+		return err
+	}
+
+	r.lock.Lock()
+	r.conn = conn
+	r.channel = channel
+	r.channelID++
+	r.lock.Unlock()
+	return nil
+}
+
+// dial connects to RabbitMQ, or returns the open shared connection
+func (r *RabbitMQ) dial() (*amqp.Connection, error) {
+	if r.shared != nil {
+		return r.shared.dial(r.uri)
+	}
+	return dialURI(r.uri)
+}
+
+// release closes the channel, and the connection unless it is shared
+func (r *RabbitMQ) release(conn *amqp.Connection, channel *amqp.Channel) {
+	if r.shared == nil {
+		conn.Close()
+		return
+	}
+	if channel != nil {
+		channel.Close()
+	}
+}
+
+// connection is shared by the channels of several publishers, and dialed
+// again by the first of them reconnecting once it is closed
+type connection struct {
+	lock    sync.Mutex
+	conn    *amqp.Connection
+	closing chan *amqp.Error
+}
+
+// dial returns the open connection, or connects to RabbitMQ
+func (c *connection) dial(uri string) (*amqp.Connection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil {
+		select {
+		case <-c.closing:
+		default:
+			return c.conn, nil
+		}
+	}
+	conn, err := dialURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.closing = conn.NotifyClose(make(chan *amqp.Error, 1))
+	return conn, nil
+}
+
+// close the shared connection
+func (c *connection) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// reconnect connects again after waiting for the backoff, attempts are
+// counted until a message has been handled on the new channel
+func (r *RabbitMQ) reconnect() error {
+	r.lock.Lock()
+	if r.conn != nil {
+		r.release(r.conn, r.channel)
+	}
+	r.lock.Unlock()
+
+	for r.attempt < r.Backoff.Attempts {
+		r.attempt++
+		d := r.Backoff.delay(r.attempt)
+		log.Printf("Reconnecting to RabbitMQ in %s, attempt %d of %d", d, r.attempt, r.Backoff.Attempts)
+
+		select {
+		case <-time.After(d):
+		case <-r.stop:
+			return errStopped
+		}
+
+		err := r.connect()
+		if err == nil {
+			log.Print("RabbitMQ reconnected")
+			return nil
+		}
+		log.Printf("Reconnect failed: %s", err)
+	}
+	return fmt.Errorf("%w: gave up reconnecting to RabbitMQ after %d attempts", ErrConnection, r.attempt)
+}
+
+// connected resets the reconnect attempts once a channel is working
+func (r *RabbitMQ) connected() {
+	r.attempt = 0
+}
+
+// currentChannel returns the open channel and its id
+func (r *RabbitMQ) currentChannel() (*amqp.Channel, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.channel, r.channelID
+}
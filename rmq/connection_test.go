@@ -0,0 +1,55 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Attempts: 10, Min: time.Second, Max: 5 * time.Second}
+
+	assert.Equal(t, time.Second, b.delay(1))
+	assert.Equal(t, 2*time.Second, b.delay(2))
+	assert.Equal(t, 4*time.Second, b.delay(3))
+	assert.Equal(t, 5*time.Second, b.delay(4), "should not wait longer than Max")
+	assert.Equal(t, 5*time.Second, b.delay(100))
+}
+
+func TestRabbitMQ_ReconnectDisabled(t *testing.T) {
+	r := &RabbitMQ{Backoff: Backoff{Attempts: 0}}
+
+	assert.Error(t, r.reconnect(), "should give up without attempts")
+}
+
+func TestRabbitMQ_ReconnectStopped(t *testing.T) {
+	r := &RabbitMQ{
+		uri:     "amqp://localhost:1/",
+		stop:    make(chan struct{}),
+		Backoff: Backoff{Attempts: 1, Min: time.Hour, Max: time.Hour},
+	}
+	r.Stop()
+
+	assert.Equal(t, errStopped, r.reconnect(), "should be interrupted by Stop")
+}
+
+func TestNewConsumer_MaxPrefetch(t *testing.T) {
+	_, err := NewConsumer("amqp://localhost:1/", "exchange", "queue", "#", "tag", MaxPrefetch+1, nil)
+
+	assert.EqualError(t, err, "prefetch 65536 is more than RabbitMQ allows, at most 65535", "should refuse a prefetch that wraps around")
+}
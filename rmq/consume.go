@@ -15,79 +15,158 @@
 package rmq
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
-// NewConsumer creates and sets up a RabbitMQ struct best used for consuming messages
-func NewConsumer(amqpURI, exchange, queue, routingKey, tag string, prefetch int) *RabbitMQ {
-	conn, err := amqp.Dial(amqpURI)
-	if err != nil {
-		log.Fatalf("writer failed to connect to Rabbit: %s", err)
-		return nil
+// MaxPrefetch is the largest prefetch count of RabbitMQ, a 16 bit integer
+const MaxPrefetch = math.MaxUint16
+
+// NewConsumer creates and sets up a RabbitMQ struct best used for consuming messages.
+// With a topology the exchange and queue are declared when missing
+func NewConsumer(amqpURI, exchange, queue, routingKey, tag string, prefetch int, topology *Topology) (*RabbitMQ, error) {
+	if prefetch > MaxPrefetch {
+		return nil, fmt.Errorf("prefetch %d is more than RabbitMQ allows, at most %d", prefetch, MaxPrefetch)
 	}
+	r := &RabbitMQ{
+		uri:             amqpURI,
+		exchange:        exchange,
+		queue:           queue,
+		routingKey:      routingKey,
+		topology:        topology,
+		tag:             tag,
+		prefetch:        prefetch,
+		contentType:     "application/json",
+		contentEncoding: "UTF-8",
+		consume:         true,
+		stop:            make(chan struct{}),
+		acked:           make(chan struct{}),
+		Backoff:         DefaultBackoff,
+	}
+	r.setup = r.setupConsumer
 
-	go func() {
-		log.Printf("writer closing: %s", <-conn.NotifyClose(make(chan *amqp.Error)))
-		log.Printf("writer blocked by rabbit: %v", <-conn.NotifyBlocked(make(chan amqp.Blocking)))
-	}()
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	if topology != nil {
+		log.Printf("Declared Exchange: %q and Queue: %q as %s", exchange, queue, topology)
+	}
+	if r.messages == 0 {
+		r.conn.Close()
+		return nil, fmt.Errorf("%w: no messages in RabbitMQ Queue: %s", ErrQueueEmpty, queue)
+	}
+	log.Print("RabbitMQ connected: ", RedactURI(amqpURI))
+	log.Printf("Bind to Exchange: %q and Queue: %q, Messaging waiting: %d, prefetch: %d", exchange, queue, r.messages, prefetch)
 
-	channel, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("writer failed to get a channel from Rabbit: %s", err)
+	return r, nil
+}
+
+// setupConsumer binds the queue, or declares it with a topology, on a new
+// channel and limits the unacked messages delivered on it to prefetch
+func (r *RabbitMQ) setupConsumer(channel *amqp.Channel) error {
+	if err := channel.Qos(
+		r.prefetch, // prefetch count
+		0,          // prefetch size
+		false,      // global
+	); err != nil {
+		return fmt.Errorf("%w: Qos: %s", ErrConnection, err)
+	}
+
+	if r.topology != nil {
+		if err := r.topology.declareExchange(channel, r.exchange); err != nil {
+			return err
+		}
+		q, err := r.topology.declareQueue(channel, r.queue, r.exchange)
+		if err != nil {
+			return err
+		}
+		r.messages = q.Messages
 		return nil
 	}
 
 	q, err := channel.QueueDeclarePassive(
-		queue, // name of the queue
-		true,  // durable
-		false, // delete when usused
-		false, // exclusive
-		false, // noWait
-		nil,   // arguments
+		r.queue, // name of the queue
+		true,    // durable
+		false,   // delete when usused
+		false,   // exclusive
+		false,   // noWait
+		nil,     // arguments
 	)
 	if err != nil {
-		log.Fatalf("Queue Declare: %s", err)
-	}
-	if q.Messages == 0 {
-		log.Fatalf("No messages in RabbitMQ Queue: %s", q.Name)
+		return wrap(ErrConnection, ErrQueueMissing, fmt.Errorf("Queue Declare: %w", err))
 	}
 	if err = channel.QueueBind(
-		q.Name,     // name of the queue
-		routingKey, // bindingKey
-		exchange,   // sourceExchange
-		false,      // noWait
-		nil,        // arguments
+		q.Name,       // name of the queue
+		r.routingKey, // bindingKey
+		r.exchange,   // sourceExchange
+		false,        // noWait
+		nil,          // arguments
 	); err != nil {
-		log.Fatalf("Queue Bind: %s", err)
+		return wrap(ErrConnection, ErrExchangeMissing, fmt.Errorf("Queue Bind: %w", err))
 	}
+	r.messages = q.Messages
+	return nil
+}
 
-	r := &RabbitMQ{
-		conn:            conn,
-		channel:         channel,
-		exchange:        exchange,
-		contentType:     "application/json",
-		contentEncoding: "UTF-8",
+// ackMultiple acks the delivery tags on the channel they were delivered on,
+// messages from a closed channel are redelivered by RabbitMQ instead
+func (r *RabbitMQ) ackMultiple(deliveryTag <-chan Verify) {
+	for v := range deliveryTag {
+		channel, id := r.currentChannel()
+		if v.Channel != id {
+			log.Printf("Skipping ack of delivery tag %d from a closed channel, the messages will be redelivered", v.Tag)
+			continue
+		}
+		if err := channel.Ack(v.Tag, v.MultiAck); err != nil {
+			log.Printf("Failed to ack delivery tag %d: %s", v.Tag, err)
+		}
 	}
-	log.Print("RabbitMQ connected: ", amqpURI)
-	log.Printf("Bind to Exchange: %q and Queue: %q, Messaging waiting: %d", exchange, queue, q.Messages)
+	close(r.acked)
+}
 
-	return r
+// Hold keeps a consumed message unacked, like a message not matching a
+// filter, to be requeued by RabbitMQ when the channel closes. Consumption
+// stops once ConsumeOptions.MaxHeld messages are held
+func (r *RabbitMQ) Hold(m Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if m.Channel != r.channelID {
+		// messages of a closed channel are already requeued
+		return
+	}
+	r.held++
+	if r.maxHeld > 0 && r.held == r.maxHeld {
+		r.Stop()
+	}
 }
 
-func (r *RabbitMQ) ackMultiple(deliveryTag <-chan Verify) {
-	for v := range deliveryTag {
-		r.channel.Ack(v.Tag, v.MultiAck)
+// stopped returns the error of a consumption stopped by Stop, as the held
+// messages stop it before the queue is consumed
+func (r *RabbitMQ) stopped(n int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.maxHeld > 0 && r.held >= r.maxHeld {
+		return fmt.Errorf("consumption stopped after %d messages, as %d held messages take up the prefetch", n, r.held)
 	}
+	log.Printf("Consumption stopped after %d messages", n)
+	return nil
 }
 
-// Consume outputs a stream of Message into a channel from rabbit
-func (r *RabbitMQ) Consume(out chan Message, verify <-chan Verify) {
-	go r.ackMultiple(verify)
+// Stop will stop consuming and close the Message channel of Consume
+func (r *RabbitMQ) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// deliveries starts consuming on the current channel
+func (r *RabbitMQ) deliveries() (<-chan amqp.Delivery, uint64, error) {
+	channel, id := r.currentChannel()
 
 	// set up a channel consumer
-	deliveries, err := r.channel.Consume(
+	deliveries, err := channel.Consume(
 		r.queue, // name
 		r.tag,   // consumerTag,
 		false,   // noAck
@@ -96,22 +175,97 @@ func (r *RabbitMQ) Consume(out chan Message, verify <-chan Verify) {
 		false,   // noWait
 		nil,     // arguments
 	)
+	return deliveries, id, err
+}
+
+// Consume outputs a stream of Message into a channel from rabbit, the channel
+// is closed when the consumption is stopped by Stop or any of the ConsumeOptions.
+// When the connection is lost Consume reconnects and continues, the messages
+// not yet acked are redelivered by RabbitMQ on the new channel. An error is
+// returned when the consumption could not continue
+func (r *RabbitMQ) Consume(out chan Message, verify <-chan Verify, o ConsumeOptions) error {
+	go r.ackMultiple(verify)
+	defer close(out)
+	r.lock.Lock()
+	r.maxHeld = o.MaxHeld
+	r.lock.Unlock()
+
+	deliveries, channelID, err := r.deliveries()
 	if err != nil {
-		log.Fatalf("rabbit consumer failed %s", err)
+		return fmt.Errorf("%w: rabbit consumer failed %s", ErrConnection, err)
+	}
+
+	// remaining is the number of messages waiting in the queue on connect
+	remaining := -1
+	if o.UntilEmpty {
+		remaining = r.messages
+	}
+
+	// idle is nil, and never fires, without an IdleTimeout
+	var idle <-chan time.Time
+	var timer *time.Timer
+	if o.IdleTimeout > 0 {
+		timer = time.NewTimer(o.IdleTimeout)
+		defer timer.Stop()
+		idle = timer.C
 	}
 
 	// process deliveries from the queue
-	for d := range deliveries {
-		// create a new Message for the rabbit message
-		msg := Message{
-			Body:        d.Body,
-			RoutingKey:  d.RoutingKey,
-			Headers:     d.Headers,
-			DeliveryTag: d.DeliveryTag,
+	var n int
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				if err := r.reconnect(); err == errStopped {
+					return r.stopped(n)
+				} else if err != nil {
+					return fmt.Errorf("consumption stopped after %d messages: %w", n, err)
+				}
+				if deliveries, channelID, err = r.deliveries(); err != nil {
+					return fmt.Errorf("%w: rabbit consumer failed %s", ErrConnection, err)
+				}
+				// the held messages are redelivered on the new channel
+				r.lock.Lock()
+				r.held = 0
+				r.lock.Unlock()
+				if o.UntilEmpty {
+					if remaining = r.messages; remaining == 0 {
+						log.Printf("Queue drained after %d messages, stopping", n)
+						return nil
+					}
+				}
+				continue
+			}
+			r.connected()
+
+			// write a new Message for the rabbit message to channel
+			m := newDeliveryMessage(d)
+			m.Channel = channelID
+			select {
+			case out <- m:
+			case <-r.stop:
+				return r.stopped(n)
+			}
+			n++
+
+			if remaining > 0 {
+				remaining--
+			}
+			if remaining == 0 || (o.MaxMessages > 0 && n >= o.MaxMessages) {
+				log.Printf("Consumed %d messages, stopping", n)
+				return nil
+			}
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(o.IdleTimeout)
+			}
+		case <-idle:
+			log.Printf("No messages received for %s, stopping after %d messages", o.IdleTimeout, n)
+			return nil
+		case <-r.stop:
+			return r.stopped(n)
 		}
-		// write Message to channel
-		out <- msg
 	}
-
-	log.Print("All messages consumed")
 }
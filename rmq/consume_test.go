@@ -0,0 +1,196 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// consume consumes from the broker, holding the messages starting with skip
+// and acking the others, and returns the error of Consume
+func consume(t *testing.T, b *broker, prefetch int, o ConsumeOptions) error {
+	r, err := NewConsumer(b.uri, "exchange", "queue", "#", "tag", prefetch, nil)
+	require.NoError(t, err)
+	out := make(chan Message, 10)
+	verify := make(chan Verify, 10)
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- r.Consume(out, verify, o)
+	}()
+
+	for m := range out {
+		if strings.HasPrefix(string(m.Body), "skip") {
+			r.Hold(m)
+		} else {
+			verify <- Verify{Tag: m.DeliveryTag, Channel: m.Channel}
+		}
+	}
+	close(verify)
+	r.Close()
+
+	select {
+	case err := <-consumed:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumption stalled")
+		return nil
+	}
+}
+
+func TestRabbitMQ_ConsumeOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		bodies []string
+		o      ConsumeOptions
+		acked  []string
+		queued []string
+	}{
+		{
+			name:   "until empty",
+			bodies: []string{"keep1", "keep2", "keep3"},
+			o:      ConsumeOptions{UntilEmpty: true},
+			acked:  []string{"keep1", "keep2", "keep3"},
+		},
+		{
+			name:   "max messages",
+			bodies: []string{"keep1", "keep2", "keep3", "keep4", "keep5"},
+			o:      ConsumeOptions{MaxMessages: 2},
+			acked:  []string{"keep1", "keep2"},
+			queued: []string{"keep3", "keep4", "keep5"},
+		},
+		{
+			name:   "queue empty before max messages",
+			bodies: []string{"keep1", "keep2", "keep3"},
+			o:      ConsumeOptions{UntilEmpty: true, MaxMessages: 10},
+			acked:  []string{"keep1", "keep2", "keep3"},
+		},
+		{
+			name:   "idle timeout",
+			bodies: []string{"keep1", "keep2"},
+			o:      ConsumeOptions{IdleTimeout: 100 * time.Millisecond},
+			acked:  []string{"keep1", "keep2"},
+		},
+		{
+			name:   "idle timeout with held messages",
+			bodies: []string{"skip1", "keep1", "skip2"},
+			o:      ConsumeOptions{IdleTimeout: 100 * time.Millisecond, MaxHeld: 4},
+			acked:  []string{"keep1"},
+			queued: []string{"skip1", "skip2"},
+		},
+		{
+			name:   "max messages with held messages",
+			bodies: []string{"skip1", "keep1", "keep2", "keep3"},
+			o:      ConsumeOptions{MaxMessages: 3, MaxHeld: 4},
+			acked:  []string{"keep1", "keep2"},
+			queued: []string{"skip1", "keep3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(t, tt.bodies...)
+
+			err := consume(t, b, 4, tt.o)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.acked, b.Acked())
+			assert.Equal(t, tt.queued, b.Queued(), "should requeue the messages not acked")
+		})
+	}
+}
+
+func TestRabbitMQ_ConsumeHeld(t *testing.T) {
+	b := newBroker(t, "skip1", "keep1", "skip2", "keep2", "keep3")
+
+	err := consume(t, b, 4, ConsumeOptions{UntilEmpty: true, MaxHeld: 3})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"keep1", "keep2", "keep3"}, b.Acked(), "should consume past the held messages")
+}
+
+func TestRabbitMQ_ConsumeHeldPrefetch(t *testing.T) {
+	// more messages not matching than the prefetch would stall consumption
+	b := newBroker(t, "skip1", "skip2", "skip3", "skip4", "skip5", "skip6", "keep1")
+
+	err := consume(t, b, 4, ConsumeOptions{UntilEmpty: true, MaxHeld: 2})
+
+	// messages already consumed when it stops are held as well
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "held messages take up the prefetch")
+	assert.Empty(t, b.Acked(), "should stop before the message past the prefetch")
+}
+
+func TestRabbitMQ_ConsumeReconnect(t *testing.T) {
+	b := newBroker(t, "m1", "m2")
+	r, err := NewConsumer(b.uri, "exchange", "queue", "#", "tag", 3, nil)
+	require.NoError(t, err)
+	r.Backoff = Backoff{Attempts: 3, Min: 50 * time.Millisecond, Max: 50 * time.Millisecond}
+	out := make(chan Message, 10)
+	verify := make(chan Verify, 10)
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- r.Consume(out, verify, ConsumeOptions{IdleTimeout: 300 * time.Millisecond})
+	}()
+
+	// messages are written and acked in batches of three, like tarballs,
+	// and a batch from a closed channel is discarded
+	var batch, written []string
+	var last Message
+	var dropped time.Time
+	var resumed time.Duration
+	for m := range out {
+		if len(batch) > 0 && m.Channel != last.Channel {
+			resumed = time.Since(dropped)
+			// the ack of the stale channel must not ack the redelivered
+			// message with the same delivery tag, out of order
+			verify <- Verify{Tag: last.DeliveryTag, Channel: last.Channel}
+			batch = nil
+		}
+		batch = append(batch, string(m.Body))
+		last = m
+		if dropped.IsZero() && len(batch) == 2 {
+			// the connection is lost with a partial batch, more messages
+			// arrive while reconnecting
+			dropped = time.Now()
+			b.Drop()
+			b.Push("m3", "m4", "m5")
+		}
+		if len(batch) == 3 {
+			written = append(written, batch...)
+			verify <- Verify{Tag: m.DeliveryTag, Channel: m.Channel, MultiAck: true}
+			batch = nil
+		}
+	}
+	written = append(written, batch...)
+	verify <- Verify{Tag: last.DeliveryTag, Channel: last.Channel, MultiAck: true}
+	close(verify)
+	r.Close()
+
+	select {
+	case err := <-consumed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumption stalled")
+	}
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4", "m5"}, written, "should write the redelivered messages once")
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4", "m5"}, b.Acked(), "should ack every message once")
+	assert.Empty(t, b.Queued())
+	assert.True(t, resumed >= r.Backoff.Min, "should resume after the backoff, not %s", resumed)
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Errors returned by the rmq package wrap one of these, check with errors.Is
+var (
+	ErrConnection       = errors.New("connection failed")
+	ErrQueueMissing     = errors.New("queue missing")
+	ErrQueueEmpty       = errors.New("queue empty")
+	ErrExchangeMissing  = errors.New("exchange missing")
+	ErrPublish          = errors.New("publish failed")
+	ErrTopologyMismatch = errors.New("topology mismatch")
+)
+
+// wrap adds the kind of error to err, a missing queue or exchange is reported
+// by RabbitMQ as 404 NOT_FOUND when declaring passively
+func wrap(kind, missing, err error) error {
+	var e *amqp.Error
+	if missing != nil && errors.As(err, &e) && e.Code == amqp.NotFound {
+		kind = missing
+	}
+	return fmt.Errorf("%w: %s", kind, err)
+}
+
+// declareError adds the kind of error to a failed declare or bind of what, a
+// conflict with an existing exchange or queue is reported by RabbitMQ as 406
+// PRECONDITION_FAILED and a declare not allowed as 403 ACCESS_REFUSED
+func declareError(what string, err error) error {
+	var e *amqp.Error
+	if errors.As(err, &e) && (e.Code == amqp.PreconditionFailed || e.Code == amqp.AccessRefused) {
+		return fmt.Errorf("%w: %s: %s", ErrTopologyMismatch, what, err)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrConnection, what, err)
+}
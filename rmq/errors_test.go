@@ -0,0 +1,52 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrap(t *testing.T) {
+	notFound := fmt.Errorf("Queue Declare: %w", &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue"})
+	accessRefused := &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"}
+
+	missing := wrap(ErrConnection, ErrQueueMissing, notFound)
+	refused := wrap(ErrConnection, ErrQueueMissing, accessRefused)
+	other := wrap(ErrConnection, nil, notFound)
+
+	assert.True(t, errors.Is(missing, ErrQueueMissing), "should be a missing queue")
+	assert.Contains(t, missing.Error(), "NOT_FOUND - no queue")
+	assert.True(t, errors.Is(refused, ErrConnection), "should be a connection error")
+	assert.True(t, errors.Is(other, ErrConnection), "should keep the kind without a missing error")
+}
+
+func TestDeclareError(t *testing.T) {
+	inequivalent := &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'x-queue-type' for queue 'orders'"}
+	refused := &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"}
+
+	mismatch := declareError(`Queue Declare "orders" as durable with arguments map[x-queue-type:quorum]`, inequivalent)
+
+	assert.True(t, errors.Is(mismatch, ErrTopologyMismatch), "should be a topology mismatch")
+	assert.False(t, errors.Is(mismatch, ErrConnection))
+	assert.Contains(t, mismatch.Error(), "map[x-queue-type:quorum]", "should include the declared arguments")
+	assert.Contains(t, mismatch.Error(), "inequivalent arg 'x-queue-type'")
+	assert.True(t, errors.Is(declareError("Queue Bind", refused), ErrTopologyMismatch))
+	assert.True(t, errors.Is(declareError("Queue Bind", amqp.ErrClosed), ErrConnection))
+}
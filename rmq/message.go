@@ -15,28 +15,73 @@
 package rmq
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// PAX record keys and prefixes used to store the AMQP message metadata
+const (
+	paxRoutingKey = "RABBITIO.amqp.routingkey"
+	paxHeaders    = "RABBITIO.amqp.headers."
+	paxProperties = "RABBITIO.amqp.properties."
+	paxRedacted   = "RABBITIO.redacted"
+)
+
 // Message contains the most basic about the message
 type Message struct {
 	Body        []byte
 	RoutingKey  string
 	Headers     amqp.Table
+	Properties  Properties
 	DeliveryTag uint64
+	// Channel identifies the consumer channel of the DeliveryTag
+	Channel uint64
+	// Tarball and Entry are the file and tar entry a Message was restored from
+	Tarball string
+	Entry   string
+	// Received is when the Message was consumed, stored as the modification
+	// time of its tar entry
+	Received time.Time
+	// Redacted are the redaction rules that changed the Message
+	Redacted []string
+	// legacy is a Message restored from a tarball written before the
+	// properties were stored
+	legacy bool
+}
+
+// Properties contains the AMQP basic properties of a message
+type Properties struct {
+	ContentType     string
+	ContentEncoding string
+	DeliveryMode    uint8
+	Priority        uint8
+	CorrelationID   string
+	ReplyTo         string
+	Expiration      string
+	MessageID       string
+	Timestamp       time.Time
+	Type            string
+	UserID          string
+	AppID           string
 }
 
 // Verify will be used to Ack Message from the queue
 type Verify struct {
 	Tag      uint64
 	MultiAck bool
+	Channel  uint64
 }
 
-// ToPAXRecords takes amqp headers and convert them to PAXRecords compatible
+// ToPAXRecords takes amqp headers and convert them to PAXRecords compatible.
+// Headers of other types than int64, float64, bool and string, like int32 or
+// the arrays and tables of x-death, are stored as JSON tagged with the AMQP
+// types, so they are restored with the same type
 func (m *Message) ToPAXRecords() map[string]string {
 
 	pax := make(map[string]string)
@@ -44,36 +89,196 @@ func (m *Message) ToPAXRecords() map[string]string {
 
 	for k, v := range m.Headers {
 		switch v.(type) {
-		case int, int32, int64:
+		case int, int64:
 			headerType = "int"
-		case float32, float64:
+		case float64:
 			headerType = "float"
 		case bool:
 			headerType = "bool"
 		case string:
 			headerType = "string"
+		default:
+			s, err := marshalField(v)
+			if err != nil {
+				log.Printf("skipping header %q: %s", k, err)
+				continue
+			}
+			pax[fmt.Sprintf("%sjson.%s", paxHeaders, k)] = s
+			continue
 		}
-		pax[fmt.Sprintf("RABBITIO.amqp.headers.%s.%s", headerType, k)] = fmt.Sprintf("%v", v)
+		pax[fmt.Sprintf("%s%s.%s", paxHeaders, headerType, k)] = fmt.Sprintf("%v", v)
+	}
+	for k, v := range m.Properties.Map() {
+		pax[paxProperties+k] = v
+	}
+	// the delivery mode is always stored, telling the tarball apart from
+	// those written before the properties were, unless the Message comes
+	// from one of those and should keep their defaults when rewritten
+	if !m.legacy {
+		pax[paxProperties+"delivery_mode"] = strconv.Itoa(int(m.Properties.DeliveryMode))
+	}
+	if len(m.Redacted) > 0 {
+		b, _ := json.Marshal(m.Redacted)
+		pax[paxRedacted] = string(b)
 	}
 	return pax
 }
 
+// Map returns the properties that are set, keyed by their AMQP name
+func (p *Properties) Map() map[string]string {
+	pax := make(map[string]string)
+	strs := map[string]string{
+		"content_type":     p.ContentType,
+		"content_encoding": p.ContentEncoding,
+		"correlation_id":   p.CorrelationID,
+		"reply_to":         p.ReplyTo,
+		"expiration":       p.Expiration,
+		"message_id":       p.MessageID,
+		"type":             p.Type,
+		"user_id":          p.UserID,
+		"app_id":           p.AppID,
+	}
+	for k, v := range strs {
+		if v != "" {
+			pax[k] = v
+		}
+	}
+	if p.DeliveryMode != 0 {
+		pax["delivery_mode"] = strconv.Itoa(int(p.DeliveryMode))
+	}
+	if p.Priority != 0 {
+		pax["priority"] = strconv.Itoa(int(p.Priority))
+	}
+	if !p.Timestamp.IsZero() {
+		// AMQP timestamps have a resolution of seconds
+		pax["timestamp"] = strconv.FormatInt(p.Timestamp.Unix(), 10)
+	}
+	return pax
+}
+
+// set a property from its AMQP name, unknown or malformed properties are ignored
+func (p *Properties) set(name, v string) {
+	switch name {
+	case "content_type":
+		p.ContentType = v
+	case "content_encoding":
+		p.ContentEncoding = v
+	case "correlation_id":
+		p.CorrelationID = v
+	case "reply_to":
+		p.ReplyTo = v
+	case "expiration":
+		p.Expiration = v
+	case "message_id":
+		p.MessageID = v
+	case "type":
+		p.Type = v
+	case "user_id":
+		p.UserID = v
+	case "app_id":
+		p.AppID = v
+	case "delivery_mode":
+		if u, err := strconv.ParseUint(v, 10, 8); err == nil {
+			p.DeliveryMode = uint8(u)
+		}
+	case "priority":
+		if u, err := strconv.ParseUint(v, 10, 8); err == nil {
+			p.Priority = uint8(u)
+		}
+	case "timestamp":
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			p.Timestamp = time.Unix(i, 0)
+		}
+	}
+}
+
+// newDeliveryMessage creates a Message from a delivery consumed from RabbitMQ
+func newDeliveryMessage(d amqp.Delivery) Message {
+	return Message{
+		Body:        d.Body,
+		RoutingKey:  d.RoutingKey,
+		Headers:     d.Headers,
+		DeliveryTag: d.DeliveryTag,
+		Received:    time.Now(),
+		Properties: Properties{
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    d.DeliveryMode,
+			Priority:        d.Priority,
+			CorrelationID:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			Expiration:      d.Expiration,
+			MessageID:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			Type:            d.Type,
+			UserID:          d.UserId,
+			AppID:           d.AppId,
+		},
+	}
+}
+
+// publishing creates an amqp.Publishing restoring the properties of the Message.
+// The user_id is only restored with keepUserID, and content type, encoding and
+// delivery mode fall back to the defaults only for tarballs written before
+// properties were preserved
+func (m *Message) publishing(contentType, contentEncoding string, keepUserID bool) amqp.Publishing {
+	p := amqp.Publishing{
+		Headers:         m.Headers,
+		ContentType:     m.Properties.ContentType,
+		ContentEncoding: m.Properties.ContentEncoding,
+		DeliveryMode:    m.Properties.DeliveryMode,
+		Priority:        m.Properties.Priority,
+		CorrelationId:   m.Properties.CorrelationID,
+		ReplyTo:         m.Properties.ReplyTo,
+		Expiration:      m.Properties.Expiration,
+		MessageId:       m.Properties.MessageID,
+		Timestamp:       m.Properties.Timestamp,
+		Type:            m.Properties.Type,
+		AppId:           m.Properties.AppID,
+		Body:            m.Body,
+	}
+	if keepUserID {
+		p.UserId = m.Properties.UserID
+	}
+	if !m.legacy {
+		return p
+	}
+	if p.ContentType == "" {
+		p.ContentType = contentType
+	}
+	if p.ContentEncoding == "" {
+		p.ContentEncoding = contentEncoding
+	}
+	if p.DeliveryMode == 0 {
+		p.DeliveryMode = amqp.Persistent
+	}
+	return p
+}
+
 // NewMessage will create a new message from a byte slice and attributes
 func NewMessage(bytes []byte, xattr map[string]string) *Message {
 
 	// add amqp header information to the Message
 	var headers = make(amqp.Table)
+	var properties Properties
 	var routingKey string
+	var redacted []string
+	legacy := true
 
 	// need to support more than just string here for v
 	for k, v := range xattr {
 
 		switch {
-		case k == "RABBITIO.amqp.routingkey":
+		case k == paxRoutingKey:
 			routingKey = v
-		case strings.HasPrefix(k, "RABBITIO.amqp.headers."):
+		case k == paxRedacted:
+			json.Unmarshal([]byte(v), &redacted)
+		case strings.HasPrefix(k, paxProperties):
+			properties.set(strings.TrimPrefix(k, paxProperties), v)
+			legacy = false
+		case strings.HasPrefix(k, paxHeaders):
 			// th is now [type, header]
-			th := strings.SplitN(strings.TrimPrefix(k, "RABBITIO.amqp.headers."), ".", 2)
+			th := strings.SplitN(strings.TrimPrefix(k, paxHeaders), ".", 2)
 			headerType := th[0]
 			header := strings.Join(th[1:], ".")
 
@@ -92,6 +297,10 @@ func NewMessage(bytes []byte, xattr map[string]string) *Message {
 				}
 			case "string":
 				headers[header] = v
+			case "json":
+				if f, err := unmarshalField(v); err == nil {
+					headers[header] = f
+				}
 			}
 		}
 	}
@@ -101,6 +310,9 @@ func NewMessage(bytes []byte, xattr map[string]string) *Message {
 		Body:       bytes,
 		RoutingKey: routingKey,
 		Headers:    headers,
+		Properties: properties,
+		Redacted:   redacted,
+		legacy:     legacy,
 	}
 
 	return m
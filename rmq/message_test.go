@@ -16,6 +16,7 @@ package rmq
 
 import (
 	"testing"
+	"time"
 
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
@@ -24,9 +25,9 @@ import (
 var (
 	myStringHeader   = "RABBITIO.amqp.headers.string.myStringHeader"
 	myStringEqHeader = "RABBITIO.amqp.headers.string.myStringEqHeader"
-	myInt32Header    = "RABBITIO.amqp.headers.int.myInt32Header"
+	myInt32Header    = "RABBITIO.amqp.headers.json.myInt32Header"
 	myInt64Header    = "RABBITIO.amqp.headers.int.myInt64Header"
-	myFloat32Header  = "RABBITIO.amqp.headers.float.myFloat32Header"
+	myFloat32Header  = "RABBITIO.amqp.headers.json.myFloat32Header"
 	myFloat64Header  = "RABBITIO.amqp.headers.float.myFloat64Header"
 	myBoolHeader     = "RABBITIO.amqp.headers.bool.myBoolHeader"
 )
@@ -45,9 +46,9 @@ func TestToPAXRecords(t *testing.T) {
 	var attrHeaders = make(map[string]string)
 	attrHeaders[myStringHeader] = "myString"
 	attrHeaders[myStringEqHeader] = "my=String"
-	attrHeaders[myInt32Header] = "32"
+	attrHeaders[myInt32Header] = `{"type":"int32","value":32}`
 	attrHeaders[myInt64Header] = "64"
-	attrHeaders[myFloat32Header] = "32.32"
+	attrHeaders[myFloat32Header] = `{"type":"float32","value":32.32}`
 	attrHeaders[myFloat64Header] = "64.64"
 	attrHeaders[myBoolHeader] = "true"
 
@@ -69,9 +70,9 @@ func TestNewMessage(t *testing.T) {
 	headers["RABBITIO.amqp.routingkey"] = "routingKey from tarball PAXRecords"
 	headers[myStringHeader] = "myString"
 	headers[myStringEqHeader] = "my=String"
-	headers[myInt32Header] = "3232"
+	headers["RABBITIO.amqp.headers.int.myInt32Header"] = "3232"
 	headers[myInt64Header] = "6464"
-	headers[myFloat32Header] = "32.123"
+	headers["RABBITIO.amqp.headers.float.myFloat32Header"] = "32.123"
 	headers[myFloat64Header] = "64.123"
 	headers[myBoolHeader] = "true"
 
@@ -81,3 +82,195 @@ func TestNewMessage(t *testing.T) {
 	assert.Equal(t, []byte("Message"), m.Body)
 	assert.NoError(t, m.Headers.Validate())
 }
+
+func TestNewMessage_LegacyHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		header   string
+		expected interface{}
+	}{
+		{"int32 written as int", "RABBITIO.amqp.headers.int.myInt32Header", "32", "myInt32Header", int64(32)},
+		{"float32 written as float", "RABBITIO.amqp.headers.float.myFloat32Header", "32.32", "myFloat32Header", float64(32.32)},
+		{"int64", myInt64Header, "64", "myInt64Header", int64(64)},
+		{"float64", myFloat64Header, "64.64", "myFloat64Header", float64(64.64)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMessage([]byte("Message"), map[string]string{tt.key: tt.value})
+
+			assert.Equal(t, tt.expected, m.Headers[tt.header], "should decode the header as written before typed JSON")
+		})
+	}
+}
+
+func TestProperties_RoundTrip(t *testing.T) {
+	properties := Properties{
+		ContentType:     "text/plain",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Transient,
+		Priority:        5,
+		CorrelationID:   "correlation",
+		ReplyTo:         "reply-queue",
+		Expiration:      "60000",
+		MessageID:       "message-1",
+		Timestamp:       time.Unix(1523456789, 0),
+		Type:            "event",
+		UserID:          "guest",
+		AppID:           "rabbitio",
+	}
+	message := &Message{Properties: properties}
+
+	pax := message.ToPAXRecords()
+
+	assert.Equal(t, "text/plain", pax["RABBITIO.amqp.properties.content_type"])
+	assert.Equal(t, "1", pax["RABBITIO.amqp.properties.delivery_mode"])
+	assert.Equal(t, "1523456789", pax["RABBITIO.amqp.properties.timestamp"])
+
+	m := NewMessage([]byte("Message"), pax)
+
+	assert.Equal(t, properties, m.Properties)
+}
+
+func TestProperties_EmptyNotStored(t *testing.T) {
+	message := &Message{Headers: amqp.Table{"myStringHeader": "myString"}}
+
+	pax := message.ToPAXRecords()
+
+	assert.Len(t, pax, 2, "should only contain the header and the delivery mode")
+	assert.Equal(t, "0", pax["RABBITIO.amqp.properties.delivery_mode"])
+}
+
+func TestMessage_Publishing(t *testing.T) {
+	legacy := NewMessage([]byte("Message"), map[string]string{paxRoutingKey: "rk"})
+	restored := &Message{Body: []byte("Message"), Properties: Properties{
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Transient,
+		MessageID:    "message-1",
+	}}
+
+	lp := legacy.publishing("application/json", "UTF-8", false)
+	rp := restored.publishing("application/json", "UTF-8", false)
+
+	assert.Equal(t, "application/json", lp.ContentType)
+	assert.Equal(t, "UTF-8", lp.ContentEncoding)
+	assert.Equal(t, amqp.Persistent, lp.DeliveryMode)
+	assert.Equal(t, "text/plain", rp.ContentType)
+	assert.Equal(t, "", rp.ContentEncoding, "should not default stored properties")
+	assert.Equal(t, amqp.Transient, rp.DeliveryMode)
+	assert.Equal(t, "message-1", rp.MessageId)
+}
+
+func TestMessage_PublishingEmptyProperties(t *testing.T) {
+	stored := &Message{Body: []byte("Message")}
+
+	m := NewMessage(stored.Body, stored.ToPAXRecords())
+	p := m.publishing("application/json", "UTF-8", false)
+
+	assert.Equal(t, "", p.ContentType, "should keep an empty content type")
+	assert.Equal(t, "", p.ContentEncoding)
+	assert.Equal(t, uint8(0), p.DeliveryMode)
+}
+
+func TestMessage_PublishingLegacyRewritten(t *testing.T) {
+	legacy := NewMessage([]byte("Message"), map[string]string{
+		paxRoutingKey: "rk",
+		"RABBITIO.amqp.headers.string.myStringHeader": "myString",
+	})
+
+	pax := legacy.ToPAXRecords()
+	m := NewMessage(legacy.Body, pax)
+	p := m.publishing("application/json", "UTF-8", false)
+
+	assert.NotContains(t, pax, "RABBITIO.amqp.properties.delivery_mode")
+	assert.Equal(t, "application/json", p.ContentType, "should keep the legacy defaults")
+	assert.Equal(t, "UTF-8", p.ContentEncoding)
+	assert.Equal(t, amqp.Persistent, p.DeliveryMode)
+	assert.Equal(t, "myString", p.Headers["myStringHeader"])
+}
+
+func TestMessage_PublishingUserID(t *testing.T) {
+	m := &Message{Body: []byte("Message"), Properties: Properties{UserID: "orders"}}
+
+	assert.Equal(t, "", m.publishing("", "", false).UserId, "should drop the user_id by default")
+	assert.Equal(t, "orders", m.publishing("", "", true).UserId)
+}
+
+func TestHeaders_RoundTrip(t *testing.T) {
+	timestamp := time.Unix(1523456789, 0)
+
+	tests := []struct {
+		name     string
+		header   interface{}
+		expected interface{}
+	}{
+		{"string", "myString", "myString"},
+		{"bool", true, true},
+		{"int64", int64(64), int64(64)},
+		{"float64", float64(64.64), float64(64.64)},
+		{"int32", int32(32), int32(32)},
+		{"float32", float32(32.5), float32(32.5)},
+		{"void", nil, nil},
+		{"byte", byte(8), byte(8)},
+		{"int16", int16(-16), int16(-16)},
+		{"bytes", []byte{0, 1, 254, 255}, []byte{0, 1, 254, 255}},
+		{"decimal", amqp.Decimal{Scale: 2, Value: 12345}, amqp.Decimal{Scale: 2, Value: 12345}},
+		{"timestamp", timestamp, timestamp},
+		{"empty array", []interface{}{}, []interface{}{}},
+		{
+			"array",
+			[]interface{}{"a", int32(1), float32(1.5), nil, []byte("b")},
+			[]interface{}{"a", int32(1), float32(1.5), nil, []byte("b")},
+		},
+		{"empty table", amqp.Table{}, amqp.Table{}},
+		{
+			"nested table",
+			amqp.Table{"a": amqp.Table{"b": []interface{}{int16(2), amqp.Table{"c": true}}}},
+			amqp.Table{"a": amqp.Table{"b": []interface{}{int16(2), amqp.Table{"c": true}}}},
+		},
+		{
+			"x-death",
+			[]interface{}{amqp.Table{
+				"count":        int64(3),
+				"reason":       "rejected",
+				"queue":        "rabbitio-queue",
+				"time":         timestamp,
+				"exchange":     "rabbitio-exchange",
+				"routing-keys": []interface{}{"rk"},
+			}},
+			[]interface{}{amqp.Table{
+				"count":        int64(3),
+				"reason":       "rejected",
+				"queue":        "rabbitio-queue",
+				"time":         timestamp,
+				"exchange":     "rabbitio-exchange",
+				"routing-keys": []interface{}{"rk"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := &Message{Headers: amqp.Table{"my.header": tt.header}}
+			assert.NoError(t, message.Headers.Validate(), "should be valid Headers")
+
+			m := NewMessage([]byte("Message"), message.ToPAXRecords())
+
+			assert.NoError(t, m.Headers.Validate(), "should be valid restored Headers")
+			assert.Contains(t, m.Headers, "my.header")
+			assert.Equal(t, tt.expected, m.Headers["my.header"])
+		})
+	}
+}
+
+func TestNewMessage_InvalidJSONHeader(t *testing.T) {
+	var headers = make(map[string]string)
+	headers["RABBITIO.amqp.headers.json.broken"] = "{not json"
+	headers["RABBITIO.amqp.headers.json.unknown"] = `{"type":"complex","value":1}`
+
+	m := NewMessage([]byte("Message"), headers)
+
+	assert.Empty(t, m.Headers, "should skip headers that can not be decoded")
+}
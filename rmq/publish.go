@@ -15,91 +15,257 @@
 package rmq
 
 import (
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
-// NewPublisher creates and sets up a RabbitMQ Publisher
-func NewPublisher(amqpURI, exchange, queue, tag string, prefetch int) *RabbitMQ {
-	conn, err := amqp.Dial(amqpURI)
-	if err != nil {
-		log.Fatalf("writer failed to connect to Rabbit: %s", err)
-		return nil
-	}
-
-	go func() {
-		log.Printf("writer closing: %s", <-conn.NotifyClose(make(chan *amqp.Error)))
-		log.Printf("writer blocked by rabbit: %v", <-conn.NotifyBlocked(make(chan amqp.Blocking)))
-	}()
-
-	channel, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("writer failed to get a channel from Rabbit: %s", err)
-		return nil
-	}
+// NewPublisher creates and sets up a RabbitMQ Publisher. With a topology the
+// exchange, and the queue when given, are declared when missing
+func NewPublisher(amqpURI, exchange, queue, tag string, prefetch int, topology *Topology) (*RabbitMQ, error) {
+	return newPublisher(amqpURI, exchange, queue, tag, prefetch, topology, nil)
+}
 
-	if err = channel.ExchangeDeclarePassive(
-		exchange, // name
-		"topic",  // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // noWait
-		nil,      // arguments
-	); err != nil {
-		log.Fatalf("Exchange Declare: %s", err)
+// newPublisher creates a Publisher with its own connection, or a channel on
+// the shared connection
+func newPublisher(amqpURI, exchange, queue, tag string, prefetch int, topology *Topology, shared *connection) (*RabbitMQ, error) {
+	if prefetch < 1 {
+		prefetch = 1
 	}
 
 	r := &RabbitMQ{
-		conn:            conn,
-		channel:         channel,
+		uri:             amqpURI,
 		exchange:        exchange,
+		queue:           queue,
+		topology:        topology,
 		contentType:     "application/json",
 		contentEncoding: "UTF-8",
+		prefetch:        prefetch,
+		publish:         true,
+		shared:          shared,
+		Backoff:         DefaultBackoff,
+	}
+	r.setup = r.setupPublisher
+
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	log.Print("RabbitMQ connected: ", RedactURI(amqpURI))
+	if topology != nil {
+		log.Printf("Declared Exchange: %q and Queue: %q as %s", exchange, queue, topology)
+	}
+
+	return r, nil
+}
+
+// setupPublisher checks the exchange, or declares it and the queue with a
+// topology, and puts a new channel in confirm mode
+func (r *RabbitMQ) setupPublisher(channel *amqp.Channel) error {
+	if err := r.topology.declareExchange(channel, r.exchange); err != nil {
+		return err
+	}
+	if r.topology != nil && r.queue != "" {
+		if _, err := r.topology.declareQueue(channel, r.queue, r.exchange); err != nil {
+			return err
+		}
 	}
-	log.Print("RabbitMQ connected: ", amqpURI)
 
-	return r
+	// confirm mode makes the broker ack or nack every published message
+	if err := channel.Confirm(false); err != nil {
+		return fmt.Errorf("%w: Confirm mode: %s", ErrConnection, err)
+	}
+	r.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, r.prefetch))
+	r.returns = channel.NotifyReturn(make(chan amqp.Return, r.prefetch))
+	return nil
 }
 
-// Publish Takes stream of messages and publish them to rabbit
-func (r *RabbitMQ) Publish(messages chan Message, o Override) {
-	for m := range messages {
+// send publishes a message on the current channel and tracks it for confirms
+func (r *RabbitMQ) send(tracker *confirmTracker, m Message, o Override) error {
+	// override routingKey stored in Message with the executed options
+	var routingKey string
+	if o.RoutingKey != "#" {
+		routingKey = o.RoutingKey
+	} else {
+		routingKey = m.RoutingKey
+	}
 
-		// override routingKey stored in Message with the executed options
-		var routingKey string
-		if o.RoutingKey != "#" {
-			routingKey = o.RoutingKey
-		} else {
-			routingKey = m.RoutingKey
+	channel, _ := r.currentChannel()
+	if err := channel.Publish(
+		r.exchange,
+		routingKey,
+		true,  // mandatory
+		false, // immediate
+		m.publishing(r.contentType, r.contentEncoding, o.KeepUserID),
+	); err != nil {
+		return err
+	}
+	tracker.add(routingKey, m)
+	return nil
+}
+
+// resend reconnects and publishes the messages again that were not
+// confirmed before the connection was lost
+func (r *RabbitMQ) resend(tracker *confirmTracker, messages []Message, o Override) {
+	for {
+		if err := r.reconnect(); err != nil {
+			for _, m := range messages {
+				r.fail(Failure{Message: m, Reason: err.Error()})
+			}
+			// there is no channel left to receive confirms from
+			r.confirms = nil
+			return
+		}
+		if len(messages) > 0 {
+			log.Printf("Publishing %d unconfirmed messages again", len(messages))
+		}
+
+		for len(messages) > 0 {
+			if err := r.send(tracker, messages[0], o); err != nil {
+				log.Printf("writer failed to write document to rabbit: %s", err)
+				break
+			}
+			messages = messages[1:]
+		}
+		if len(messages) == 0 {
+			return
+		}
+		messages = append(tracker.reset(), messages...)
+	}
+}
+
+// Publish Takes stream of messages and publish them to rabbit. Messages are
+// published as mandatory and are only counted as restored when the broker
+// confirms them, up to prefetch messages are waiting for a confirm at a time.
+// When the connection is lost the unconfirmed messages are published again
+// after reconnecting. When messages is closed, an error is returned if any of
+// the messages were not restored
+func (r *RabbitMQ) Publish(messages chan Message, o Override) error {
+	tracker := new(confirmTracker)
+	t := r.newThrottle()
+
+	for {
+		// stop reading messages while too many are waiting for a confirm,
+		// or while throttled
+		in := messages
+		if tracker.len() >= r.prefetch {
+			in = nil
+		}
+		unblocked, wake := r.wait(t, time.Now())
+		if unblocked != nil || wake != nil {
+			in = nil
 		}
 
-		if err := r.channel.Publish(
-			r.exchange,
-			routingKey,
-			false, // mandatory
-			false, // immediate
-			amqp.Publishing{
-				Headers:         m.Headers,
-				ContentType:     r.contentType,
-				ContentEncoding: r.contentEncoding,
-				Body:            m.Body,
-				DeliveryMode:    amqp.Persistent,
-			},
-		); err != nil {
-			log.Fatalf("writer failed to write document to rabbit: %s", err)
+		select {
+		case m, ok := <-in:
+			if !ok {
+				if failed := len(r.Failures()); failed > 0 {
+					return fmt.Errorf("%w: %d messages were not restored", ErrPublish, failed)
+				}
+				return nil
+			}
+			if t.limiter != nil {
+				t.limiter.take()
+			}
+			if err := r.send(tracker, m, o); err != nil {
+				log.Printf("writer failed to write document to rabbit: %s", err)
+				r.resend(tracker, append(tracker.reset(), m), o)
+			}
+
+		case <-unblocked:
+		case <-wake:
+
+		case ret, ok := <-r.returns:
+			if !ok {
+				r.returns = nil
+				continue
+			}
+			tracker.returned(ret)
+
+		case c, ok := <-r.confirms:
+			if !ok {
+				// the channel is closed, nothing waiting will be confirmed
+				r.resend(tracker, tracker.reset(), o)
+				continue
+			}
+			// a basic.return is always sent before the confirm of the message
+			r.drainReturns(tracker)
+			m, f, settled := tracker.confirm(c)
+			switch {
+			case !settled:
+				log.Printf("confirm for unknown delivery tag %d", c.DeliveryTag)
+			case f != nil:
+				r.fail(*f)
+			default:
+				r.connected()
+				r.lock.Lock()
+				r.confirmed++
+				r.lock.Unlock()
+				if r.Acks != nil {
+					r.Acks <- Verify{Tag: m.DeliveryTag, Channel: m.Channel}
+				}
+				r.Wg.Done()
+			}
 		}
-		r.Wg.Done()
 	}
 }
 
-// Close will close the RabbitMQ channel and connection
+// drainReturns passes the already received returns to the tracker
+func (r *RabbitMQ) drainReturns(tracker *confirmTracker) {
+	for {
+		select {
+		case ret, ok := <-r.returns:
+			if !ok {
+				r.returns = nil
+				return
+			}
+			tracker.returned(ret)
+		default:
+			return
+		}
+	}
+}
+
+// fail records a message the broker did not accept
+func (r *RabbitMQ) fail(f Failure) {
+	log.Printf("Message %s from %s was not restored: %s", f.Message.Entry, f.Message.Tarball, f.Reason)
+	r.lock.Lock()
+	r.failures = append(r.failures, f)
+	r.lock.Unlock()
+	r.Wg.Done()
+}
+
+// Confirmed returns the number of published messages confirmed by the broker
+func (r *RabbitMQ) Confirmed() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.confirmed
+}
+
+// Failures returns the published messages that were nacked or returned
+func (r *RabbitMQ) Failures() []Failure {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Failure(nil), r.failures...)
+}
+
+// Close will close the RabbitMQ channel and connection, a consumer waits for
+// the pending acks to be sent before closing
 func (r *RabbitMQ) Close() error {
+	if r.consume {
+		<-r.acked
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	err := r.channel.Close()
 	if err != nil {
 		return err
 	}
+	if r.shared != nil {
+		// the shared connection is closed by the Publishers
+		return nil
+	}
 	err = r.conn.Close()
 	if err != nil {
 		return err
@@ -0,0 +1,129 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publish publishes the bodies to the broker and returns the error of Publish,
+// the messages channel is closed once every message is confirmed or failed
+func publish(t *testing.T, r *RabbitMQ, bodies ...string) error {
+	var wg sync.WaitGroup
+	r.Wg = &wg
+	messages := make(chan Message, len(bodies))
+	published := make(chan error, 1)
+	go func() {
+		published <- r.Publish(messages, Override{RoutingKey: "#"})
+	}()
+
+	for i, body := range bodies {
+		wg.Add(1)
+		messages <- Message{Body: []byte(body), RoutingKey: "key", Entry: body + ".rio", Tarball: "data/1_messages_4.tgz", DeliveryTag: uint64(i + 1)}
+	}
+	wg.Wait()
+	close(messages)
+
+	select {
+	case err := <-published:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing stalled")
+		return nil
+	}
+}
+
+func TestRabbitMQ_PublishFailures(t *testing.T) {
+	b := newBroker(t)
+	r, err := NewPublisher(b.uri, "exchange", "", "tag", 10, nil)
+	require.NoError(t, err)
+	defer r.Close()
+
+	err = publish(t, r, "ok1", "return1", "nack1", "ok2")
+
+	assert.True(t, errors.Is(err, ErrPublish), "should end with ErrPublish, got %v", err)
+	assert.Equal(t, 2, r.Confirmed())
+	assert.Equal(t, []string{"ok1", "ok2"}, b.Published())
+
+	failures := r.Failures()
+	require.Len(t, failures, 2)
+	reasons := make(map[string]string)
+	for _, f := range failures {
+		reasons[string(f.Message.Body)] = f.Reason
+	}
+	assert.Equal(t, "returned: 312 NO_ROUTE", reasons["return1"], "should fail the unroutable message")
+	assert.Equal(t, "nacked by broker", reasons["nack1"])
+}
+
+func TestRabbitMQ_PublishConfirmed(t *testing.T) {
+	b := newBroker(t)
+	r, err := NewPublisher(b.uri, "exchange", "", "tag", 2, nil)
+	require.NoError(t, err)
+	defer r.Close()
+
+	err = publish(t, r, "ok1", "ok2", "ok3")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, r.Confirmed())
+	assert.Empty(t, r.Failures())
+}
+
+func TestRabbitMQ_PublishAcks(t *testing.T) {
+	source := newBroker(t, "m1", "nack2", "m3")
+	target := newBroker(t)
+	consumer, err := NewConsumer(source.uri, "exchange", "queue", "#", "tag", 3, nil)
+	require.NoError(t, err)
+	publisher, err := NewPublisher(target.uri, "exchange", "", "tag", 3, nil)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	// messages are acked on the source only once the target confirms them
+	verify := make(chan Verify, 3)
+	publisher.Acks = verify
+	consumed := make(chan Message, 3)
+	consumeErr := make(chan error, 1)
+	go func() {
+		consumeErr <- consumer.Consume(consumed, verify, ConsumeOptions{UntilEmpty: true})
+	}()
+	var wg sync.WaitGroup
+	publisher.Wg = &wg
+	publishing := make(chan Message, 3)
+	published := make(chan error, 1)
+	go func() {
+		published <- publisher.Publish(publishing, Override{RoutingKey: "#"})
+	}()
+
+	for m := range consumed {
+		wg.Add(1)
+		publishing <- m
+	}
+	wg.Wait()
+	close(publishing)
+	err = <-published
+	close(verify)
+	consumer.Close()
+
+	assert.NoError(t, <-consumeErr)
+	assert.True(t, errors.Is(err, ErrPublish), "should end with ErrPublish, got %v", err)
+	assert.Equal(t, []string{"m1", "m3"}, target.Published())
+	assert.Equal(t, []string{"m1", "m3"}, source.Acked())
+	assert.Equal(t, []string{"nack2"}, source.Queued(), "should requeue the nacked message in the source")
+}
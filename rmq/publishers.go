@@ -0,0 +1,168 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+// Publishers publish messages in parallel over several channels
+type Publishers struct {
+	workers []*RabbitMQ
+	shared  *connection
+	Backoff Backoff
+	Wg      *sync.WaitGroup
+	// Throttle limits how fast the Publishers publish together
+	Throttle Throttle
+	// PreserveOrder publishes all messages with the same routing key on the
+	// same channel, keeping their order
+	PreserveOrder bool
+}
+
+// NewPublishers creates workers Publishers on channels of one connection, or
+// with connections a connection for every channel
+func NewPublishers(amqpURI, exchange, queue, tag string, prefetch, workers int, connections bool, topology *Topology) (*Publishers, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Publishers{Backoff: DefaultBackoff}
+	if !connections && workers > 1 {
+		p.shared = new(connection)
+	}
+
+	for i := 0; i < workers; i++ {
+		r, err := newPublisher(amqpURI, exchange, queue, tag, prefetch, topology, p.shared)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.workers = append(p.workers, r)
+	}
+	if workers > 1 {
+		log.Printf("Publishing with %d workers", workers)
+	}
+	return p, nil
+}
+
+// Publish the messages over all channels, returning when messages is closed
+// and every worker is done. Without PreserveOrder the workers take the next
+// message when ready, and an error is returned if any of the messages were
+// not restored
+func (p *Publishers) Publish(messages chan Message, o Override) error {
+	n := len(p.workers)
+	// the workers share a limiter, so the rate holds however unevenly the
+	// messages are spread over them
+	var shared *limiter
+	if p.Throttle.Rate > 0 {
+		shared = newLimiter(p.Throttle.Rate, p.Throttle.Burst)
+	}
+
+	inputs := make([]chan Message, n)
+	for i := range inputs {
+		inputs[i] = messages
+	}
+	if p.PreserveOrder && n > 1 {
+		for i := range inputs {
+			inputs[i] = make(chan Message, cap(messages))
+		}
+		go dispatch(messages, inputs, o)
+	}
+
+	errs := make(chan error, n)
+	for i, r := range p.workers {
+		r.Backoff = p.Backoff
+		r.Wg = p.Wg
+		r.Throttle = p.Throttle
+		r.limiter = shared
+		go func(r *RabbitMQ, in chan Message) {
+			errs <- r.Publish(in, o)
+		}(r, inputs[i])
+	}
+
+	var err error
+	for range p.workers {
+		// the failures of all workers are counted below
+		if e := <-errs; e != nil && !errors.Is(e, ErrPublish) && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if failed := len(p.Failures()); failed > 0 {
+		return fmt.Errorf("%w: %d messages were not restored", ErrPublish, failed)
+	}
+	return nil
+}
+
+// dispatch sends the messages to the input chosen by the hash of the routing
+// key they are published with, and closes the inputs when messages is closed
+func dispatch(messages <-chan Message, inputs []chan Message, o Override) {
+	for m := range messages {
+		routingKey := m.RoutingKey
+		if o.RoutingKey != "#" {
+			routingKey = o.RoutingKey
+		}
+		h := fnv.New32a()
+		h.Write([]byte(routingKey))
+		inputs[h.Sum32()%uint32(len(inputs))] <- m
+	}
+	for _, in := range inputs {
+		close(in)
+	}
+}
+
+// QueueDepth returns the number of messages waiting in the queue
+func (p *Publishers) QueueDepth(queue string) (int, error) {
+	return p.workers[0].QueueDepth(queue)
+}
+
+// Confirmed returns the number of messages confirmed by the broker
+func (p *Publishers) Confirmed() int {
+	var n int
+	for _, r := range p.workers {
+		n += r.Confirmed()
+	}
+	return n
+}
+
+// Failures returns the messages that were nacked or returned
+func (p *Publishers) Failures() []Failure {
+	var failures []Failure
+	for _, r := range p.workers {
+		failures = append(failures, r.Failures()...)
+	}
+	return failures
+}
+
+// Close closes the channels and connections of all workers
+func (p *Publishers) Close() error {
+	var err error
+	for _, r := range p.workers {
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if p.shared != nil {
+		if e := p.shared.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
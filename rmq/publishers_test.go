@@ -0,0 +1,129 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dispatched returns the routing keys and bodies of the messages per input
+func dispatched(messages []Message, n int, o Override) [][]string {
+	in := make(chan Message, len(messages))
+	for _, m := range messages {
+		in <- m
+	}
+	close(in)
+	inputs := make([]chan Message, n)
+	for i := range inputs {
+		inputs[i] = make(chan Message, len(messages))
+	}
+	dispatch(in, inputs, o)
+
+	out := make([][]string, n)
+	for i, input := range inputs {
+		for m := range input {
+			out[i] = append(out[i], m.RoutingKey+":"+string(m.Body))
+		}
+	}
+	return out
+}
+
+func TestDispatch(t *testing.T) {
+	var messages []Message
+	for i := 0; i < 30; i++ {
+		messages = append(messages, Message{RoutingKey: fmt.Sprintf("key%d", i%5), Body: []byte(fmt.Sprint(i))})
+	}
+
+	out := dispatched(messages, 3, Override{RoutingKey: "#"})
+
+	var n, used int
+	seen := make(map[string]int)
+	for i, input := range out {
+		if len(input) > 0 {
+			used++
+		}
+		last := make(map[string]int)
+		for _, m := range input {
+			var key string
+			var body int
+			fmt.Sscanf(m, "%4s:%d", &key, &body)
+			if w, ok := seen[key]; ok {
+				assert.Equal(t, w, i, "should publish %s on one channel", key)
+			}
+			seen[key] = i
+			if prev, ok := last[key]; ok {
+				assert.True(t, prev < body, "should keep the order of %s", key)
+			}
+			last[key] = body
+			n++
+		}
+	}
+	assert.Equal(t, 30, n)
+	assert.True(t, used > 1, "should spread the routing keys over the channels")
+}
+
+func TestDispatch_Override(t *testing.T) {
+	messages := []Message{{RoutingKey: "a"}, {RoutingKey: "b"}, {RoutingKey: "c"}}
+
+	out := dispatched(messages, 4, Override{RoutingKey: "all"})
+
+	var used int
+	for _, input := range out {
+		if len(input) > 0 {
+			assert.Len(t, input, 3, "should publish all messages on one channel")
+			used++
+		}
+	}
+	assert.Equal(t, 1, used)
+}
+
+func TestPublishers_PublishRate(t *testing.T) {
+	b := newBroker(t)
+	// the broker serves a single channel on every connection
+	p, err := NewPublishers(b.uri, "exchange", "", "tag", 10, 2, true, nil)
+	require.NoError(t, err)
+	defer p.Close()
+	var wg sync.WaitGroup
+	p.Wg = &wg
+	p.PreserveOrder = true
+	p.Throttle = Throttle{Rate: 20, Burst: 1}
+
+	// all messages have the same routing key and go to the same worker,
+	// which must still get the whole rate
+	messages := make(chan Message, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		messages <- Message{Body: []byte(fmt.Sprintf("ok%d", i)), RoutingKey: "orders"}
+	}
+	start := time.Now()
+	published := make(chan error, 1)
+	go func() {
+		published <- p.Publish(messages, Override{RoutingKey: "#"})
+	}()
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(messages)
+
+	assert.NoError(t, <-published)
+	assert.Equal(t, 5, p.Confirmed())
+	assert.True(t, elapsed >= 150*time.Millisecond, "should publish at the rate, took %s", elapsed)
+	assert.True(t, elapsed < 350*time.Millisecond, "should not split the rate between the workers, took %s", elapsed)
+}
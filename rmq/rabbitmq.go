@@ -16,27 +16,78 @@ package rmq
 
 import (
 	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
 // RabbitMQ type for talking to RabbitMQ
 type RabbitMQ struct {
+	uri             string
 	conn            *amqp.Connection
+	shared          *connection
 	channel         *amqp.Channel
+	channelID       uint64
+	setup           func(*amqp.Channel) error
+	topology        *Topology
+	attempt         int
 	override        Override
 	exchange        string
+	routingKey      string
 	contentType     string
 	contentEncoding string
 	queue           string
 	tag             string
 	prefetch        int
+	messages        int
 	consume         bool
 	publish         bool
+	stop            chan struct{}
+	stopOnce        sync.Once
+	acked           chan struct{}
+	confirms        chan amqp.Confirmation
+	returns         chan amqp.Return
+	lock            sync.Mutex
+	confirmed       int
+	held            int
+	maxHeld         int
+	failures        []Failure
+	blocked         chan struct{}
+	Backoff         Backoff
 	Wg              *sync.WaitGroup
+	// Throttle limits how fast Publish publishes messages
+	Throttle Throttle
+	// limiter is the limiter of the Throttle shared by Publishers
+	limiter *limiter
+	// Acks receives a Verify for every confirmed message, to ack messages
+	// consumed from another RabbitMQ only once they are published
+	Acks chan<- Verify
 }
 
 // Override will be used to override RabbitMQ settings on publishing messages
 type Override struct {
 	RoutingKey string
+	// KeepUserID restores the user_id property, RabbitMQ rejects messages
+	// with another user_id than the user publishing them
+	KeepUserID bool
+}
+
+// Failure is a published Message that was not accepted by the broker
+type Failure struct {
+	Message Message
+	Reason  string
+}
+
+// ConsumeOptions will be used to stop consuming messages without interruption
+type ConsumeOptions struct {
+	// UntilEmpty stops after the messages waiting in the queue when connecting
+	UntilEmpty bool
+	// IdleTimeout stops when no message has been received for the duration
+	IdleTimeout time.Duration
+	// MaxMessages stops after the number of messages
+	MaxMessages int
+	// MaxHeld stops with an error once this number of messages are held
+	// unacked with Hold, as they take up the prefetch and would stall the
+	// consumption
+	MaxHeld int
 }
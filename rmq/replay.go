@@ -0,0 +1,102 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Sources of the time of a message when replaying
+const (
+	TimingConsumed  = "consumed"
+	TimingTimestamp = "timestamp"
+)
+
+// Replay paces messages by the time between them when they were captured
+type Replay struct {
+	// Timing is TimingConsumed for the time the message was consumed, or
+	// TimingTimestamp for the AMQP timestamp property
+	Timing string
+	// Speed multiplies the pace, 10 replays ten times faster
+	Speed float64
+	// MaxGap is the longest wait between two messages, zero is unlimited
+	MaxGap time.Duration
+	// now and sleep are the clock, replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewReplay creates a Replay for the timing, speed and longest gap
+func NewReplay(timing string, speed float64, maxGap time.Duration) (*Replay, error) {
+	timing = strings.ToLower(timing)
+	if timing != TimingConsumed && timing != TimingTimestamp {
+		return nil, fmt.Errorf("unknown timing %q, expected %s or %s", timing, TimingConsumed, TimingTimestamp)
+	}
+	if speed <= 0 {
+		return nil, fmt.Errorf("speed must be positive, got %g", speed)
+	}
+	return &Replay{Timing: timing, Speed: speed, MaxGap: maxGap, now: time.Now, sleep: time.Sleep}, nil
+}
+
+// at returns the time the message was captured, zero when unknown
+func (r *Replay) at(m *Message) time.Time {
+	if r.Timing == TimingTimestamp {
+		return m.Properties.Timestamp
+	}
+	return m.Received
+}
+
+// Pace forwards the messages from in to out in order, waiting between them
+// the time between their capture divided by the speed. Messages without a
+// time and messages captured before the previous one are forwarded right
+// away. out is closed when in is closed
+func (r *Replay) Pace(in <-chan Message, out chan<- Message) {
+	var previous time.Time
+	var next time.Time
+	var n, untimed int
+
+	for m := range in {
+		t := r.at(&m)
+		switch {
+		case t.IsZero():
+			untimed++
+		case previous.IsZero():
+			previous, next = t, r.now()
+		case !t.After(previous):
+			// captured before the previous message, the pace keeps to the
+			// latest time so the following messages do not wait twice
+		default:
+			gap := t.Sub(previous)
+			if r.MaxGap > 0 && gap > r.MaxGap {
+				gap = r.MaxGap
+			}
+			previous = t
+			next = next.Add(time.Duration(float64(gap) / r.Speed))
+			if d := next.Sub(r.now()); d > 0 {
+				r.sleep(d)
+			}
+		}
+		out <- m
+		n++
+	}
+	close(out)
+
+	if untimed > 0 {
+		log.Printf("Replayed %d messages, %d without a %s time", n, untimed, r.Timing)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replay paces the messages captured at the offsets with a fake clock and
+// returns the waits
+func replay(r *Replay, offsets ...time.Duration) []time.Duration {
+	clock := time.Date(2018, 3, 15, 15, 37, 45, 0, time.UTC)
+	var waits []time.Duration
+	r.now = func() time.Time { return clock }
+	r.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		clock = clock.Add(d)
+	}
+
+	in := make(chan Message, len(offsets))
+	out := make(chan Message, len(offsets))
+	captured := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, o := range offsets {
+		m := Message{Received: captured.Add(o)}
+		if o < 0 {
+			m.Received = time.Time{}
+		}
+		in <- m
+	}
+	close(in)
+	r.Pace(in, out)
+	return waits
+}
+
+func TestReplay_Pace(t *testing.T) {
+	r, err := NewReplay("consumed", 1, 0)
+	assert.NoError(t, err)
+
+	waits := replay(r, 0, time.Second, 3*time.Second, 3*time.Second)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits)
+}
+
+func TestReplay_PaceSpeedAndMaxGap(t *testing.T) {
+	r, _ := NewReplay("consumed", 10, 5*time.Second)
+
+	waits := replay(r, 0, time.Second, time.Hour, 30*time.Minute, time.Hour+10*time.Second)
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		500 * time.Millisecond, // the gap of an hour is capped to 5s
+		500 * time.Millisecond, // the message captured earlier does not wait
+	}, waits)
+}
+
+func TestReplay_PaceOutOfOrder(t *testing.T) {
+	r, _ := NewReplay("consumed", 1, 0)
+
+	waits := replay(r, 0, 10*time.Second, 5*time.Second, 12*time.Second)
+	assert.Equal(t, []time.Duration{10 * time.Second, 2 * time.Second}, waits, "should wait from the latest time, not the out of order one")
+}
+
+func TestReplay_PaceUntimed(t *testing.T) {
+	r, _ := NewReplay("consumed", 1, 0)
+
+	waits := replay(r, -1, 0, -1, 2*time.Second)
+	assert.Equal(t, []time.Duration{2 * time.Second}, waits, "should not wait for messages without a time")
+}
+
+func TestReplay_Timestamp(t *testing.T) {
+	r, _ := NewReplay("TIMESTAMP", 1, 0)
+	ts := time.Unix(1521128265, 0)
+	m := Message{Received: time.Now(), Properties: Properties{Timestamp: ts}}
+
+	assert.Equal(t, ts, r.at(&m))
+}
+
+func TestNewReplay_Invalid(t *testing.T) {
+	_, err := NewReplay("published", 1, 0)
+	assert.Error(t, err)
+	_, err = NewReplay("consumed", 0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// typedValue is an AMQP field value tagged with its type, so that it can be
+// stored as JSON and decoded back into the exact same Go type
+type typedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// decimal is the JSON representation of an amqp.Decimal
+type decimal struct {
+	Scale uint8 `json:"scale"`
+	Value int32 `json:"value"`
+}
+
+// encodeField converts an AMQP field value into its typed JSON form
+func encodeField(v interface{}) (*typedValue, error) {
+	var t string
+	var value interface{}
+
+	switch fv := v.(type) {
+	case nil:
+		return &typedValue{Type: "void"}, nil
+	case bool:
+		t, value = "bool", fv
+	case byte:
+		t, value = "byte", fv
+	case int16:
+		t, value = "int16", fv
+	case int32:
+		t, value = "int32", fv
+	case int64:
+		t, value = "int64", fv
+	case float32:
+		t, value = "float32", fv
+	case float64:
+		t, value = "float64", fv
+	case string:
+		t, value = "string", fv
+	case []byte:
+		t, value = "bytes", fv
+	case amqp.Decimal:
+		t, value = "decimal", decimal{Scale: fv.Scale, Value: fv.Value}
+	case time.Time:
+		// AMQP timestamps have a resolution of seconds
+		t, value = "timestamp", fv.Unix()
+	case []interface{}:
+		array := make([]*typedValue, len(fv))
+		for i, e := range fv {
+			tv, err := encodeField(e)
+			if err != nil {
+				return nil, fmt.Errorf("in array %s", err)
+			}
+			array[i] = tv
+		}
+		t, value = "array", array
+	case amqp.Table:
+		table := make(map[string]*typedValue, len(fv))
+		for k, e := range fv {
+			tv, err := encodeField(e)
+			if err != nil {
+				return nil, fmt.Errorf("table field %q %s", k, err)
+			}
+			table[k] = tv
+		}
+		t, value = "table", table
+	default:
+		return nil, fmt.Errorf("value %T not supported", v)
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &typedValue{Type: t, Value: raw}, nil
+}
+
+// decodeField converts a typed JSON value back into an AMQP field value
+func decodeField(tv *typedValue) (interface{}, error) {
+	if tv == nil {
+		return nil, fmt.Errorf("missing typed value")
+	}
+	var err error
+
+	switch tv.Type {
+	case "void":
+		return nil, nil
+	case "bool":
+		var v bool
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "byte":
+		var v byte
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int16":
+		var v int16
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int32":
+		var v int32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int64":
+		var v int64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float32":
+		var v float32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float64":
+		var v float64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "string":
+		var v string
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "decimal":
+		var v decimal
+		err = json.Unmarshal(tv.Value, &v)
+		return amqp.Decimal{Scale: v.Scale, Value: v.Value}, err
+	case "timestamp":
+		var v int64
+		err = json.Unmarshal(tv.Value, &v)
+		return time.Unix(v, 0), err
+	case "array":
+		var raw []*typedValue
+		if err = json.Unmarshal(tv.Value, &raw); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, len(raw))
+		for i, e := range raw {
+			if array[i], err = decodeField(e); err != nil {
+				return nil, fmt.Errorf("in array %s", err)
+			}
+		}
+		return array, nil
+	case "table":
+		var raw map[string]*typedValue
+		if err = json.Unmarshal(tv.Value, &raw); err != nil {
+			return nil, err
+		}
+		table := make(amqp.Table, len(raw))
+		for k, e := range raw {
+			if table[k], err = decodeField(e); err != nil {
+				return nil, fmt.Errorf("table field %q %s", k, err)
+			}
+		}
+		return table, nil
+	}
+
+	return nil, fmt.Errorf("type %q not supported", tv.Type)
+}
+
+// marshalField encodes an AMQP field value into a JSON string
+func marshalField(v interface{}) (string, error) {
+	tv, err := encodeField(v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(tv)
+	return string(b), err
+}
+
+// unmarshalField decodes a JSON string created by marshalField
+func unmarshalField(s string) (interface{}, error) {
+	tv := new(typedValue)
+	if err := json.Unmarshal([]byte(s), tv); err != nil {
+		return nil, err
+	}
+	return decodeField(tv)
+}
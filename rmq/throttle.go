@@ -0,0 +1,212 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Throttle limits how fast a publisher publishes messages
+type Throttle struct {
+	// Rate is the number of messages published per second, zero is unlimited
+	Rate float64
+	// Burst is the number of messages published at once without waiting,
+	// zero is a tenth of the Rate
+	Burst int
+	// PauseBlocked pauses publishing while RabbitMQ blocks the connection
+	PauseBlocked bool
+	// Queue and MaxDepth pause publishing while the queue has more than
+	// MaxDepth messages, checked every Interval
+	Queue    string
+	MaxDepth int
+	Interval time.Duration
+}
+
+// DefaultDepthInterval is the Interval between checks of the queue depth
+const DefaultDepthInterval = time.Second
+
+// limiter is a token bucket of Throttle.Rate messages per second, it can be
+// shared by several publishers
+type limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter creates a full limiter for the rate and burst
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate/10)))
+	}
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// delay returns how long to wait before the next message can be published
+func (l *limiter) delay(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// take a token for a published message, a publisher taking the last token
+// right after another leaves the next one waiting longer
+func (l *limiter) take() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tokens--
+}
+
+// throttle is the state of the Throttle while publishing
+type throttle struct {
+	Throttle
+	limiter *limiter
+	checked time.Time
+	full    bool
+}
+
+// newThrottle starts throttling publishing by the Throttle
+func (r *RabbitMQ) newThrottle() *throttle {
+	t := &throttle{Throttle: r.Throttle, limiter: r.limiter}
+	if t.Rate > 0 && t.limiter == nil {
+		t.limiter = newLimiter(t.Rate, t.Burst)
+	}
+	if t.Interval <= 0 {
+		t.Interval = DefaultDepthInterval
+	}
+	return t
+}
+
+// wait returns the channels to wait for before publishing the next message,
+// or nil channels when the message can be published right away
+func (r *RabbitMQ) wait(t *throttle, now time.Time) (unblocked <-chan struct{}, wake <-chan time.Time) {
+	if t.PauseBlocked {
+		if unblocked = r.unblocked(); unblocked != nil {
+			return unblocked, nil
+		}
+	}
+
+	if t.MaxDepth > 0 {
+		if now.Sub(t.checked) >= t.Interval {
+			r.checkDepth(t, now)
+		}
+		if t.full {
+			return nil, time.After(t.checked.Add(t.Interval).Sub(now))
+		}
+	}
+
+	if t.limiter != nil {
+		if d := t.limiter.delay(now); d > 0 {
+			return nil, time.After(d)
+		}
+	}
+	return nil, nil
+}
+
+// checkDepth pauses publishing while the queue has more than MaxDepth
+// messages, keeping the previous state when the depth is not known
+func (r *RabbitMQ) checkDepth(t *throttle, now time.Time) {
+	t.checked = now
+	depth, err := r.QueueDepth(t.Queue)
+	if err != nil {
+		log.Printf("Failed to check the depth of queue %s: %s", t.Queue, err)
+		return
+	}
+
+	full := depth > t.MaxDepth
+	switch {
+	case full && !t.full:
+		log.Printf("Pausing publishing, queue %s has %d messages, more than %d", t.Queue, depth, t.MaxDepth)
+	case !full && t.full:
+		log.Printf("Resuming publishing, queue %s has %d messages", t.Queue, depth)
+	}
+	t.full = full
+}
+
+// QueueDepth returns the number of messages waiting in the queue, declared
+// passively on a channel of its own, as a missing queue closes the channel
+func (r *RabbitMQ) QueueDepth(queue string) (int, error) {
+	r.lock.Lock()
+	conn := r.conn
+	r.lock.Unlock()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to get a channel from Rabbit: %s", ErrConnection, err)
+	}
+	defer channel.Close()
+
+	q, err := channel.QueueDeclarePassive(
+		queue, // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		return 0, wrap(ErrConnection, ErrQueueMissing, fmt.Errorf("Queue Declare: %w", err))
+	}
+	return q.Messages, nil
+}
+
+// blocking follows the blocked notifications of the connection, a closed
+// channel is unblocked
+func (r *RabbitMQ) blocking(notifications <-chan amqp.Blocking) {
+	for b := range notifications {
+		if b.Active {
+			log.Printf("connection blocked by rabbit: %s", b.Reason)
+		} else {
+			log.Print("connection unblocked by rabbit")
+		}
+		r.setBlocked(b.Active)
+	}
+	r.setBlocked(false)
+}
+
+// setBlocked records whether the connection is blocked
+func (r *RabbitMQ) setBlocked(blocked bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case blocked && r.blocked == nil:
+		r.blocked = make(chan struct{})
+	case !blocked && r.blocked != nil:
+		close(r.blocked)
+		r.blocked = nil
+	}
+}
+
+// unblocked returns a channel closed when the blocked connection is
+// unblocked, or nil when it is not blocked
+func (r *RabbitMQ) unblocked() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.blocked
+}
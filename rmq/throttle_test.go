@@ -0,0 +1,81 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Delay(t *testing.T) {
+	l := newLimiter(10, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, time.Duration(0), l.delay(now), "should publish a burst without waiting")
+		l.take()
+	}
+	assert.Equal(t, 100*time.Millisecond, l.delay(now))
+	assert.Equal(t, 50*time.Millisecond, l.delay(now.Add(50*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), l.delay(now.Add(100*time.Millisecond)))
+
+	l.take()
+	assert.Equal(t, time.Duration(0), l.delay(now.Add(time.Hour)), "should fill up to the burst")
+	l.take()
+	l.take()
+	assert.NotEqual(t, time.Duration(0), l.delay(now.Add(time.Hour)))
+}
+
+func TestNewLimiter_Burst(t *testing.T) {
+	assert.Equal(t, float64(100), newLimiter(1000, 0).burst, "should default to a tenth of the rate")
+	assert.Equal(t, float64(1), newLimiter(5, 0).burst)
+	assert.Equal(t, float64(3), newLimiter(1000, 3).burst)
+}
+
+func TestRabbitMQ_WaitBlocked(t *testing.T) {
+	r := &RabbitMQ{Throttle: Throttle{PauseBlocked: true}}
+	th := r.newThrottle()
+
+	unblocked, wake := r.wait(th, time.Now())
+	assert.Nil(t, unblocked)
+	assert.Nil(t, wake)
+
+	r.setBlocked(true)
+	unblocked, _ = r.wait(th, time.Now())
+	assert.NotNil(t, unblocked, "should wait while the connection is blocked")
+
+	r.setBlocked(false)
+	select {
+	case <-unblocked:
+	default:
+		t.Error("should be closed when the connection is unblocked")
+	}
+	unblocked, _ = r.wait(th, time.Now())
+	assert.Nil(t, unblocked)
+}
+
+func TestRabbitMQ_WaitRate(t *testing.T) {
+	r := &RabbitMQ{Throttle: Throttle{Rate: 1, Burst: 1}}
+	th := r.newThrottle()
+	now := time.Now()
+
+	_, wake := r.wait(th, now)
+	assert.Nil(t, wake)
+	th.limiter.take()
+	_, wake = r.wait(th, now)
+	assert.NotNil(t, wake, "should wait for the rate")
+}
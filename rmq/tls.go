@@ -0,0 +1,116 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TLS configures connecting to amqps:// URIs with a private CA or a client
+// certificate
+type TLS struct {
+	// CA is a PEM file with the certificates to verify RabbitMQ with, instead
+	// of the system roots
+	CA string
+	// Cert and Key are PEM files with a client certificate and its key
+	Cert string
+	Key  string
+	// ServerName verifies RabbitMQ by another name than the host of the URI
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// TLSConfig is used by NewConsumer and NewPublisher to connect to amqps://
+// URIs, nil uses the system roots. amqp:// URIs connect without TLS
+var TLSConfig *tls.Config
+
+// Config returns the TLS configuration, nil when nothing is configured
+func (t TLS) Config() (*tls.Config, error) {
+	if t == (TLS{}) {
+		return nil, nil
+	}
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in CA %s", t.CA)
+		}
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key")
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, authenticating by the client
+// certificate
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// dialURI connects to RabbitMQ with the TLSConfig when the URI is amqps://,
+// so a move can connect to one broker over TLS and another without. With a
+// client certificate and no credentials in the URI it authenticates with
+// EXTERNAL
+func dialURI(uri string) (*amqp.Connection, error) {
+	if TLSConfig == nil {
+		return amqp.Dial(uri)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqps" {
+		return amqp.Dial(uri)
+	}
+	// DialConfig sets the server name of the configuration to the host
+	config := amqp.Config{
+		Heartbeat:       10 * time.Second,
+		Locale:          "en_US",
+		TLSClientConfig: TLSConfig.Clone(),
+	}
+	if len(TLSConfig.Certificates) > 0 && u.User == nil {
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	return amqp.DialConfig(uri, config)
+}
@@ -0,0 +1,270 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certificate creates a certificate signed by the parent, self-signed when
+// the parent is nil, and writes it with its key to name.crt and name.key
+func certificate(t *testing.T, dir, name string, parent *tls.Certificate, ca bool, hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              hosts,
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+// handshake is what the stand-in learned about a client
+type handshake struct {
+	client    string
+	mechanism string
+}
+
+// standIn terminates TLS like RabbitMQ and answers the AMQP protocol header
+// with connection.start, reporting the client certificate and the SASL
+// mechanism picked in connection.start-ok before hanging up
+func standIn(t *testing.T, cert, ca tls.Certificate) (string, chan handshake) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	handshakes := make(chan handshake, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- serve(conn.(*tls.Conn))
+		}
+	}()
+	return l.Addr().String(), handshakes
+}
+
+func serve(conn *tls.Conn) handshake {
+	defer conn.Close()
+	var h handshake
+	if err := conn.Handshake(); err != nil {
+		return h
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		h.client = certs[0].Subject.CommonName
+	}
+
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return h
+	}
+	var start []byte
+	start = binary.BigEndian.AppendUint16(start, 10) // connection
+	start = binary.BigEndian.AppendUint16(start, 10) // start
+	start = append(start, 0, 9)
+	start = binary.BigEndian.AppendUint32(start, 0) // server properties
+	for _, s := range []string{"EXTERNAL PLAIN", "en_US"} {
+		start = binary.BigEndian.AppendUint32(start, uint32(len(s)))
+		start = append(start, s...)
+	}
+	frame := []byte{1, 0, 0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(start)))
+	frame = append(append(frame, start...), 0xce)
+	if _, err := conn.Write(frame); err != nil {
+		return h
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return h
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h
+	}
+	// class and method, then the client properties and the mechanism
+	properties := binary.BigEndian.Uint32(payload[4:])
+	mechanism := payload[8+properties:]
+	h.mechanism = string(mechanism[1 : 1+mechanism[0]])
+	return h
+}
+
+func TestTLS_Dial(t *testing.T) {
+	dir := t.TempDir()
+	ca := certificate(t, dir, "ca", nil, true)
+	server := certificate(t, dir, "server", &ca, false, "rabbit.internal")
+	certificate(t, dir, "client", &ca, false)
+	addr, handshakes := standIn(t, server, ca)
+	defer func() { TLSConfig = nil }()
+
+	tests := []struct {
+		name      string
+		tls       TLS
+		uri       string
+		client    string
+		mechanism string
+	}{
+		{
+			name:      "external",
+			tls:       TLS{CA: dir + "/ca.crt", Cert: dir + "/client.crt", Key: dir + "/client.key", ServerName: "rabbit.internal"},
+			uri:       "amqps://" + addr + "/",
+			client:    "client",
+			mechanism: "EXTERNAL",
+		},
+		{
+			name:      "plain with credentials",
+			tls:       TLS{CA: dir + "/ca.crt", Cert: dir + "/client.crt", Key: dir + "/client.key", ServerName: "rabbit.internal"},
+			uri:       "amqps://guest:guest@" + addr + "/",
+			client:    "client",
+			mechanism: "PLAIN",
+		},
+		{
+			name:      "private ca",
+			tls:       TLS{CA: dir + "/ca.crt", ServerName: "rabbit.internal"},
+			uri:       "amqps://guest:guest@" + addr + "/",
+			mechanism: "PLAIN",
+		},
+		{
+			name:      "insecure",
+			tls:       TLS{InsecureSkipVerify: true},
+			uri:       "amqps://guest:guest@" + addr + "/",
+			mechanism: "PLAIN",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			TLSConfig, err = test.tls.Config()
+			require.NoError(t, err)
+
+			_, err = dialURI(test.uri)
+
+			assert.Error(t, err, "should be hung up on by the stand-in")
+			h := <-handshakes
+			assert.Equal(t, test.client, h.client)
+			assert.Equal(t, test.mechanism, h.mechanism)
+		})
+	}
+}
+
+func TestTLS_DialUnverified(t *testing.T) {
+	dir := t.TempDir()
+	ca := certificate(t, dir, "ca", nil, true)
+	server := certificate(t, dir, "server", &ca, false, "rabbit.internal")
+	addr, handshakes := standIn(t, server, ca)
+	defer func() { TLSConfig = nil }()
+
+	TLSConfig, _ = TLS{ServerName: "rabbit.internal"}.Config()
+	_, err := dialURI("amqps://" + addr + "/")
+	assert.Error(t, err, "should not trust the server without its CA")
+	<-handshakes
+
+	TLSConfig, _ = TLS{CA: dir + "/ca.crt", ServerName: "other.internal"}.Config()
+	_, err = dialURI("amqps://" + addr + "/")
+	assert.Error(t, err, "should verify the server name")
+	<-handshakes
+}
+
+func TestTLS_DialMixedSchemes(t *testing.T) {
+	dir := t.TempDir()
+	ca := certificate(t, dir, "ca", nil, true)
+	server := certificate(t, dir, "server", &ca, false, "rabbit.internal")
+	certificate(t, dir, "client", &ca, false)
+	addr, handshakes := standIn(t, server, ca)
+	b := newBroker(t)
+	defer func() { TLSConfig = nil }()
+
+	var err error
+	TLSConfig, err = TLS{CA: dir + "/ca.crt", Cert: dir + "/client.crt", Key: dir + "/client.key", ServerName: "rabbit.internal"}.Config()
+	require.NoError(t, err)
+
+	// like a move from an amqps:// source to an amqp:// target
+	dialURI("amqps://" + addr + "/")
+	assert.Equal(t, "client", (<-handshakes).client, "should connect to amqps:// with TLS")
+	conn, err := dialURI(b.uri)
+	require.NoError(t, err, "should connect to amqp:// without TLS")
+	conn.Close()
+}
+
+func TestTLS_Config(t *testing.T) {
+	dir := t.TempDir()
+	certificate(t, dir, "client", nil, false)
+	ioutil.WriteFile(filepath.Join(dir, "empty.crt"), []byte("no certificates"), 0600)
+
+	c, err := TLS{}.Config()
+	assert.NoError(t, err)
+	assert.Nil(t, c, "should not configure TLS without settings")
+
+	c, err = TLS{Cert: dir + "/client.crt", Key: dir + "/client.key"}.Config()
+	assert.NoError(t, err)
+	assert.Len(t, c.Certificates, 1)
+
+	_, err = TLS{Cert: dir + "/client.crt"}.Config()
+	assert.Error(t, err, "should need a key for the certificate")
+	_, err = TLS{CA: dir + "/missing.crt"}.Config()
+	assert.Error(t, err)
+	_, err = TLS{CA: dir + "/empty.crt"}.Config()
+	assert.Error(t, err, "should need certificates in the CA")
+	_, err = TLS{Cert: dir + "/client.crt", Key: dir + "/empty.crt"}.Config()
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Topology declares the exchange and the queue when missing, and binds the
+// queue to the exchange, instead of only checking that they exist
+type Topology struct {
+	// ExchangeType is direct, fanout, topic or headers
+	ExchangeType string `json:"exchange_type"`
+	// Durable exchanges and queues survive a restart of RabbitMQ
+	Durable bool `json:"durable"`
+	// QueueArgs are the arguments of the queue, like x-queue-type,
+	// x-message-ttl or x-dead-letter-exchange
+	QueueArgs amqp.Table `json:"queue_arguments,omitempty"`
+	// Bindings are the routing keys binding the queue to the exchange
+	Bindings []string `json:"bindings,omitempty"`
+}
+
+// Validate checks the exchange type and the queue arguments
+func (t *Topology) Validate() error {
+	switch t.ExchangeType {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return fmt.Errorf("invalid exchange type %q, expected direct, fanout, topic or headers", t.ExchangeType)
+	}
+	switch t.QueueArgs["x-queue-type"] {
+	case nil, "classic":
+	case "quorum", "stream":
+		if !t.Durable {
+			return fmt.Errorf("%s queues are always durable", t.QueueArgs["x-queue-type"])
+		}
+	default:
+		return fmt.Errorf("invalid queue type %v, expected classic, quorum or stream", t.QueueArgs["x-queue-type"])
+	}
+	return t.arguments().Validate()
+}
+
+// durability is durable or transient
+func (t *Topology) durability() string {
+	if t.Durable {
+		return "durable"
+	}
+	return "transient"
+}
+
+// String describes the topology for the logs
+func (t *Topology) String() string {
+	s := fmt.Sprintf("%s %s exchange", t.durability(), t.ExchangeType)
+	if len(t.QueueArgs) > 0 {
+		s += fmt.Sprintf(", queue arguments %v", map[string]interface{}(t.QueueArgs))
+	}
+	if len(t.Bindings) > 0 {
+		s += fmt.Sprintf(", bound with %s", strings.Join(t.Bindings, ", "))
+	}
+	return s
+}
+
+// arguments returns the queue arguments with whole numbers as integers, as
+// they are floats when read from JSON and RabbitMQ expects integers
+func (t *Topology) arguments() amqp.Table {
+	if len(t.QueueArgs) == 0 {
+		return nil
+	}
+	args := make(amqp.Table, len(t.QueueArgs))
+	for k, v := range t.QueueArgs {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			v = int64(f)
+		}
+		args[k] = v
+	}
+	return args
+}
+
+// declareExchange declares the exchange, without a topology it only checks
+// that a topic exchange exists
+func (t *Topology) declareExchange(channel *amqp.Channel, exchange string) error {
+	if t == nil {
+		if err := channel.ExchangeDeclarePassive(
+			exchange, // name
+			"topic",  // type
+			true,     // durable
+			false,    // auto-deleted
+			false,    // internal
+			false,    // noWait
+			nil,      // arguments
+		); err != nil {
+			return wrap(ErrConnection, ErrExchangeMissing, fmt.Errorf("Exchange Declare: %w", err))
+		}
+		return nil
+	}
+	// the default exchange always exists
+	if exchange == "" {
+		return nil
+	}
+	if err := channel.ExchangeDeclare(
+		exchange,       // name
+		t.ExchangeType, // type
+		t.Durable,      // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // noWait
+		nil,            // arguments
+	); err != nil {
+		return declareError(fmt.Sprintf("Exchange Declare %q as %s %s", exchange, t.durability(), t.ExchangeType), err)
+	}
+	return nil
+}
+
+// declareQueue declares the queue and binds it to the exchange with the
+// routing keys of the bindings
+func (t *Topology) declareQueue(channel *amqp.Channel, queue, exchange string) (amqp.Queue, error) {
+	q, err := channel.QueueDeclare(
+		queue,         // name of the queue
+		t.Durable,     // durable
+		false,         // delete when usused
+		false,         // exclusive
+		false,         // noWait
+		t.arguments(), // arguments
+	)
+	if err != nil {
+		return q, declareError(fmt.Sprintf("Queue Declare %q as %s with arguments %v", queue, t.durability(), map[string]interface{}(t.arguments())), err)
+	}
+	if exchange == "" {
+		return q, nil
+	}
+	for _, key := range t.Bindings {
+		if err := channel.QueueBind(
+			q.Name,   // name of the queue
+			key,      // bindingKey
+			exchange, // sourceExchange
+			false,    // noWait
+			nil,      // arguments
+		); err != nil {
+			return q, declareError(fmt.Sprintf("Queue Bind %q to %q with %q", q.Name, exchange, key), err)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,60 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopology_Validate(t *testing.T) {
+	assert.NoError(t, (&Topology{ExchangeType: "topic", Durable: true}).Validate())
+	assert.NoError(t, (&Topology{ExchangeType: "headers", Durable: true, QueueArgs: amqp.Table{"x-queue-type": "quorum"}}).Validate())
+
+	assert.Error(t, (&Topology{ExchangeType: "x-delayed"}).Validate(), "should know the exchange type")
+	assert.Error(t, (&Topology{ExchangeType: "fanout", Durable: false, QueueArgs: amqp.Table{"x-queue-type": "quorum"}}).Validate(), "should need durable quorum queues")
+	assert.Error(t, (&Topology{ExchangeType: "direct", QueueArgs: amqp.Table{"x-queue-type": "lazy"}}).Validate())
+	assert.Error(t, (&Topology{ExchangeType: "direct", QueueArgs: amqp.Table{"x-max-length": uint(1)}}).Validate(), "should only accept AMQP field types")
+}
+
+func TestTopology_Arguments(t *testing.T) {
+	var topology Topology
+	b, _ := json.Marshal(Topology{
+		ExchangeType: "topic",
+		Durable:      true,
+		QueueArgs:    amqp.Table{"x-message-ttl": int64(60000), "x-dead-letter-exchange": "dlx", "x-ratio": 0.5},
+	})
+	assert.NoError(t, json.Unmarshal(b, &topology))
+
+	args := topology.arguments()
+
+	assert.Equal(t, int64(60000), args["x-message-ttl"], "should declare whole numbers from JSON as integers")
+	assert.Equal(t, "dlx", args["x-dead-letter-exchange"])
+	assert.Equal(t, 0.5, args["x-ratio"])
+	assert.Nil(t, (&Topology{}).arguments())
+}
+
+func TestTopology_String(t *testing.T) {
+	topology := &Topology{
+		ExchangeType: "direct",
+		QueueArgs:    amqp.Table{"x-queue-type": "classic"},
+		Bindings:     []string{"orders", "invoices"},
+	}
+
+	assert.Equal(t, "transient direct exchange, queue arguments map[x-queue-type:classic], bound with orders, invoices", topology.String())
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 Meltwater
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rmq
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// RedactURI returns the AMQP URI without the password
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "invalid URI"
+	}
+	if _, set := u.User.Password(); set {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// Password returns the password in the AMQP URI, empty without a password.
+// The password of an invalid URI is still found, to be masked in its errors
+func Password(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		userinfo := uri
+		if i := strings.Index(uri, "://"); i >= 0 {
+			userinfo = uri[i+3:]
+		}
+		if at := strings.LastIndex(userinfo, "@"); at >= 0 {
+			userinfo = userinfo[:at]
+			if colon := strings.Index(userinfo, ":"); colon >= 0 {
+				return userinfo[colon+1:]
+			}
+		}
+		return ""
+	}
+	password, _ := u.User.Password()
+	return password
+}
+
+// WithPassword returns the AMQP URI with the password of its user
+func WithPassword(uri, password string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.New("invalid URI")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", errors.New("a password needs a user in the URI")
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// VHost returns the virtual host of the AMQP URI
+func VHost(uri string) string {
+	u, err := amqp.ParseURI(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Vhost
+}